@@ -0,0 +1,336 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"html"
+	"strconv"
+	"strings"
+)
+
+// Lines longer than this are converted without waiting for their end.
+const ansiMaxLine = 64 * 1024
+
+// ansiConverter converts logs with ANSI escape sequences to HTML. SGR
+// sequences (colors, bold...) become styled spans, other control sequences
+// are removed.
+//
+// Input is converted a line at a time, so escape sequences and characters
+// split between writes are handled, and a line overwritten with `\r`, like
+// a progress bar, only shows its final state.
+type ansiConverter struct {
+	style ansiStyle
+	// Input not converted yet.
+	buf []byte
+}
+
+type ansiStyle struct {
+	// CSS colors, "" for the default.
+	fg, bg string
+
+	bold, faint, italic, underline, strike, inverse bool
+}
+
+func (s ansiStyle) css() string {
+	fg, bg := s.fg, s.bg
+	if s.inverse {
+		fg, bg = bg, fg
+		if fg == "" {
+			fg = "#fff"
+		}
+		if bg == "" {
+			bg = "#000"
+		}
+	}
+
+	var res []string
+	if fg != "" {
+		res = append(res, "color:"+fg)
+	}
+	if bg != "" {
+		res = append(res, "background-color:"+bg)
+	}
+	if s.bold {
+		res = append(res, "font-weight:bold")
+	}
+	if s.faint {
+		res = append(res, "opacity:0.7")
+	}
+	if s.italic {
+		res = append(res, "font-style:italic")
+	}
+	if s.underline && s.strike {
+		res = append(res, "text-decoration:underline line-through")
+	} else if s.underline {
+		res = append(res, "text-decoration:underline")
+	} else if s.strike {
+		res = append(res, "text-decoration:line-through")
+	}
+	return strings.Join(res, ";")
+}
+
+// The 16 basic colors, darkened a bit to be readable on a white background.
+var ansiPalette = [16]string{
+	"#000000", "#cd0000", "#00a000", "#a68000", "#0000ee", "#cd00cd", "#00a0a0", "#a0a0a0",
+	"#555555", "#ff3333", "#00c000", "#c0a000", "#5c5cff", "#ff33ff", "#00c0c0", "#c0c0c0",
+}
+
+// ansi256Color returns the CSS color for xterm's 256 color palette.
+func ansi256Color(n int) string {
+	switch {
+	case n < 16:
+		return ansiPalette[n]
+	case n < 232:
+		n -= 16
+		levels := [6]int{0, 95, 135, 175, 215, 255}
+		return fmt.Sprintf("#%02x%02x%02x", levels[n/36], levels[n/6%6], levels[n%6])
+	default:
+		g := 8 + 10*(n-232)
+		return fmt.Sprintf("#%02x%02x%02x", g, g, g)
+	}
+}
+
+// applySGR updates the style with the parameters of an SGR sequence.
+func (s *ansiStyle) applySGR(params string) {
+	var codes []int
+	for _, p := range strings.FieldsFunc(params, func(r rune) bool { return r == ';' || r == ':' }) {
+		n, err := strconv.Atoi(p)
+		if err != nil {
+			return
+		}
+		codes = append(codes, n)
+	}
+	if len(codes) == 0 {
+		codes = []int{0}
+	}
+
+	for i := 0; i < len(codes); i++ {
+		c := codes[i]
+		switch {
+		case c == 0:
+			*s = ansiStyle{}
+		case c == 1:
+			s.bold = true
+		case c == 2:
+			s.faint = true
+		case c == 3:
+			s.italic = true
+		case c == 4:
+			s.underline = true
+		case c == 7:
+			s.inverse = true
+		case c == 9:
+			s.strike = true
+		case c == 22:
+			s.bold = false
+			s.faint = false
+		case c == 23:
+			s.italic = false
+		case c == 24:
+			s.underline = false
+		case c == 27:
+			s.inverse = false
+		case c == 29:
+			s.strike = false
+		case c >= 30 && c <= 37:
+			s.fg = ansiPalette[c-30]
+		case c >= 90 && c <= 97:
+			s.fg = ansiPalette[c-90+8]
+		case c == 39:
+			s.fg = ""
+		case c >= 40 && c <= 47:
+			s.bg = ansiPalette[c-40]
+		case c >= 100 && c <= 107:
+			s.bg = ansiPalette[c-100+8]
+		case c == 49:
+			s.bg = ""
+		case c == 38 || c == 48:
+			// 38;5;n or 38;2;r;g;b
+			color := ""
+			if i+2 < len(codes) && codes[i+1] == 5 {
+				if n := codes[i+2]; n >= 0 && n < 256 {
+					color = ansi256Color(n)
+				}
+				i += 2
+			} else if i+4 < len(codes) && codes[i+1] == 2 {
+				color = fmt.Sprintf("#%02x%02x%02x", codes[i+2]&0xff, codes[i+3]&0xff, codes[i+4]&0xff)
+				i += 4
+			} else {
+				// Don't know how long it is, ignore the rest.
+				return
+			}
+			if c == 38 {
+				s.fg = color
+			} else {
+				s.bg = color
+			}
+		}
+	}
+}
+
+// Convert converts the complete lines in p, along with the input held back
+// from previous calls.
+func (c *ansiConverter) Convert(p []byte) string {
+	c.buf = append(c.buf, p...)
+
+	end := bytes.LastIndexByte(c.buf, '\n') + 1
+	partial := false
+	if end == 0 {
+		if len(c.buf) < ansiMaxLine {
+			return ""
+		}
+		end = len(c.buf)
+		partial = true
+	}
+
+	var out strings.Builder
+	n := c.convert(&out, c.buf[:end], partial)
+	if n == 0 && partial {
+		// A huge unterminated sequence, give up on it.
+		n = c.convert(&out, c.buf[:end], false)
+	}
+	c.buf = append(c.buf[:0], c.buf[n:]...)
+	return out.String()
+}
+
+// Flush converts all the input held back, for when there's no more.
+func (c *ansiConverter) Flush() string {
+	var out strings.Builder
+	c.convert(&out, c.buf, false)
+	c.buf = c.buf[:0]
+	return out.String()
+}
+
+// Buffered returns the number of input bytes held back.
+func (c *ansiConverter) Buffered() int {
+	return len(c.buf)
+}
+
+// convert writes data as HTML to out, and returns how many bytes it consumed.
+// If partial, incomplete characters and sequences at the end aren't consumed.
+func (c *ansiConverter) convert(out *strings.Builder, data []byte, partial bool) int {
+	if partial {
+		data, _ = splitUTF8(data)
+	}
+
+	var line strings.Builder
+	var text []byte
+	flushText := func() {
+		if len(text) == 0 {
+			return
+		}
+		if css := c.style.css(); css != "" {
+			fmt.Fprintf(&line, `<span style="%s">%s</span>`, css, html.EscapeString(string(text)))
+		} else {
+			line.WriteString(html.EscapeString(string(text)))
+		}
+		text = text[:0]
+	}
+
+	i := 0
+loop:
+	for i < len(data) {
+		b := data[i]
+		switch {
+		case b == '\n':
+			flushText()
+			out.WriteString(line.String())
+			out.WriteByte('\n')
+			line.Reset()
+			i++
+		case b == '\r':
+			j := i
+			for j < len(data) && data[j] == '\r' {
+				j++
+			}
+			if j == len(data) && partial {
+				// Might be a \r\n.
+				break loop
+			}
+			flushText()
+			if j < len(data) && data[j] != '\n' {
+				// Overwriting the line.
+				line.Reset()
+			}
+			i = j
+		case b == 0x1b:
+			n, complete := c.escape(data[i:], flushText)
+			if !complete {
+				if partial {
+					break loop
+				}
+				// Unterminated, drop just the ESC.
+				n = 1
+			}
+			i += n
+		case b < 0x20 && b != '\t', b == 0x7f:
+			i++
+		default:
+			text = append(text, b)
+			i++
+		}
+	}
+	flushText()
+	out.WriteString(line.String())
+	return i
+}
+
+// escape handles the escape sequence at the start of data, and returns its
+// length. It returns false if the sequence doesn't end in data.
+func (c *ansiConverter) escape(data []byte, flushText func()) (int, bool) {
+	if len(data) < 2 {
+		return 0, false
+	}
+
+	switch data[1] {
+	case '[':
+		// CSI: parameters, intermediates, final byte.
+		i := 2
+		for i < len(data) && data[i] >= 0x30 && data[i] <= 0x3f {
+			i++
+		}
+		params := string(data[2:i])
+		intermediates := i
+		for i < len(data) && data[i] >= 0x20 && data[i] <= 0x2f {
+			i++
+		}
+		if i == len(data) {
+			return 0, false
+		}
+		if data[i] < 0x40 || data[i] > 0x7e {
+			// Malformed, drop what we have.
+			return i, true
+		}
+		if data[i] == 'm' && i == intermediates {
+			flushText()
+			c.style.applySGR(params)
+		}
+		return i + 1, true
+	case ']', 'P', 'X', '^', '_':
+		// Strings (OSC, DCS...), terminated by BEL or ESC \.
+		// Not across lines, so a missing terminator doesn't hide the log.
+		for i := 2; i < len(data) && data[i] != '\n'; i++ {
+			if data[i] == 0x07 {
+				return i + 1, true
+			}
+			if data[i] == 0x1b && i+1 < len(data) && data[i+1] == '\\' {
+				return i + 2, true
+			}
+		}
+		return 0, false
+	default:
+		// ESC, intermediates, final byte.
+		i := 1
+		for i < len(data) && data[i] >= 0x20 && data[i] <= 0x2f {
+			i++
+		}
+		if i == len(data) {
+			return 0, false
+		}
+		if data[i] < 0x30 || data[i] > 0x7e {
+			// Malformed, drop what we have.
+			return i, true
+		}
+		return i + 1, true
+	}
+}
@@ -0,0 +1,51 @@
+package main
+
+import "testing"
+
+func TestANSIConverter(t *testing.T) {
+	for _, tc := range []struct {
+		in, want string
+	}{
+		{"plain <b>&\n", "plain &lt;b&gt;&amp;\n"},
+		{"\x1b[31merror\x1b[0m: foo\n", `<span style="color:#cd0000">error</span>: foo` + "\n"},
+		{"\x1b[1m\x1b[32mok\x1b[39m bold\x1b[m\n", `<span style="color:#00a000;font-weight:bold">ok</span><span style="font-weight:bold"> bold</span>` + "\n"},
+		{"\x1b[38;5;196mx\x1b[48;2;1;2;3my\n", `<span style="color:#ff0000">x</span><span style="color:#ff0000;background-color:#010203">y</span>` + "\n"},
+		// Colors carry over lines.
+		{"\x1b[34ma\nb\n", `<span style="color:#0000ee">a</span>` + "\n" + `<span style="color:#0000ee">b</span>` + "\n"},
+		// Other sequences and control characters are removed.
+		{"\x1b[2K\x1b[1Ga\x1b]8;;http://x\x1b\\b\x1b]8;;\x07c\x1b(Bd\x07\b\n", "abcd\n"},
+		// Progress bars show their final state.
+		{"10%\r50%\r100%\ndone\r\n", "100%\ndone\n"},
+		// Unterminated sequences don't hide the log.
+		{"a\x1b]8;;\nb\n", "a]8;;\nb\n"},
+		// Malformed sequences don't eat the line end.
+		{"a\x1b\nb\x1b(\nc\n", "a\nb\nc\n"},
+	} {
+		var c ansiConverter
+		got := c.Convert([]byte(tc.in)) + c.Flush()
+		if got != tc.want {
+			t.Errorf("converting %q:\ngot  %q\nwant %q", tc.in, got, tc.want)
+		}
+
+		// The result must be the same when written a byte at a time.
+		var c2 ansiConverter
+		got = ""
+		for i := range tc.in {
+			got += c2.Convert([]byte{tc.in[i]})
+		}
+		got += c2.Flush()
+		if got != tc.want {
+			t.Errorf("converting %q a byte at a time:\ngot  %q\nwant %q", tc.in, got, tc.want)
+		}
+	}
+}
+
+func TestANSIConverterHoldsUnfinishedLines(t *testing.T) {
+	var c ansiConverter
+	if got := c.Convert([]byte("a\nb\x1b[3")); got != "a\n" || c.Buffered() != 4 {
+		t.Errorf("got %q with %d bytes buffered", got, c.Buffered())
+	}
+	if got := c.Convert([]byte("1mc\n")); got != `b<span style="color:#cd0000">c</span>`+"\n" || c.Buffered() != 0 {
+		t.Errorf("got %q with %d bytes buffered", got, c.Buffered())
+	}
+}
@@ -0,0 +1,409 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+)
+
+// apiRoutes returns the versioned JSON API. Read endpoints are public, like the
+// HTML pages. Write endpoints need the `api_token` from the config.
+func (s *Service) apiRoutes() http.Handler {
+	r := chi.NewRouter()
+	r.Get("/jobs", s.HandleAPIJobs)
+	r.Get("/jobs/{jobID}", s.HandleAPIJob)
+	r.Get("/jobs/{jobID}/log", s.HandleAPIJobLog)
+	r.Get("/jobs/{jobID}/artifacts", s.HandleAPIJobArtifacts)
+	r.Get("/search", s.HandleAPISearch)
+	r.Get("/artifacts/usage", s.HandleAPIArtifactsUsage)
+	r.Group(func(r chi.Router) {
+		r.Use(s.apiAuth)
+		r.Post("/jobs", s.HandleAPITrigger)
+		r.Post("/jobs/{jobID}/cancel", s.HandleAPICancel)
+	})
+	return r
+}
+
+func apiJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	err := json.NewEncoder(w).Encode(v)
+	if err != nil {
+		log.Printf("failed to send API response: %v", err)
+	}
+}
+
+func apiError(w http.ResponseWriter, status int, format string, args ...any) {
+	apiJSON(w, status, map[string]string{"error": fmt.Sprintf(format, args...)})
+}
+
+func (s *Service) apiAuth(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if s.config.APIToken == "" {
+			apiError(w, 403, "write API is disabled, set api_token in the config to enable it")
+			return
+		}
+		token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok || subtle.ConstantTimeCompare([]byte(token), []byte(s.config.APIToken)) != 1 {
+			apiError(w, 401, "invalid or missing token")
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// apiJob gets the job in the URL, or sends an error and returns nil.
+func (s *Service) apiJob(w http.ResponseWriter, r *http.Request) *Job {
+	jobID := chi.URLParam(r, "jobID")
+	if !validJobID(jobID) {
+		apiError(w, 404, "job not found")
+		return nil
+	}
+	job, err := s.db.getJob(jobID)
+	if err != nil {
+		log.Printf("failed to get job: %v", err)
+		apiError(w, 500, "failed to get job")
+		return nil
+	}
+	if job == nil {
+		apiError(w, 404, "job not found")
+		return nil
+	}
+	return job
+}
+
+type apiJobResponse struct {
+	*Job
+	// Always nil, to leave out the job's fields with the same names. The read
+	// API is public.
+	Script          *struct{} `json:"script,omitempty"`
+	Permissions     *struct{} `json:"permissions,omitempty"`
+	PermissionRepos *struct{} `json:"permission_repos,omitempty"`
+	// Position in the queue, only set for queued jobs.
+	QueuePosition int `json:"queue_position,omitempty"`
+}
+
+// HandleAPIJobs lists jobs, newest first. Query parameters filter them:
+// repo (owner/name), branch, pr, sha, state, name, and limit (default 50, max 1000).
+func (s *Service) HandleAPIJobs(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+
+	limit := 50
+	if l := q.Get("limit"); l != "" {
+		n, err := strconv.Atoi(l)
+		if err != nil || n <= 0 || n > 1000 {
+			apiError(w, 400, "invalid limit '%s', must be between 1 and 1000", l)
+			return
+		}
+		limit = n
+	}
+	pr := 0
+	if p := q.Get("pr"); p != "" {
+		n, err := strconv.Atoi(p)
+		if err != nil {
+			apiError(w, 400, "invalid pr '%s'", p)
+			return
+		}
+		pr = n
+	}
+
+	jobs, err := s.db.listJobs(func(j *Job) bool {
+		if repo := q.Get("repo"); repo != "" && *j.Repo.FullName != repo {
+			return false
+		}
+		if branch := q.Get("branch"); branch != "" && j.Attributes["branch"] != branch {
+			return false
+		}
+		if pr != 0 && (j.PullRequest == nil || *j.PullRequest.Number != pr) {
+			return false
+		}
+		if sha := q.Get("sha"); sha != "" && !strings.HasPrefix(j.SHA, sha) {
+			return false
+		}
+		if state := q.Get("state"); state != "" && string(j.State) != state {
+			return false
+		}
+		if name := q.Get("name"); name != "" && j.Name != name {
+			return false
+		}
+		return true
+	}, limit)
+	if err != nil {
+		log.Printf("failed to list jobs: %v", err)
+		apiError(w, 500, "failed to list jobs")
+		return
+	}
+
+	res := []apiJobResponse{}
+	for _, job := range jobs {
+		res = append(res, s.apiJobResponse(job))
+	}
+	apiJSON(w, 200, map[string]any{"jobs": res})
+}
+
+func (s *Service) apiJobResponse(job *Job) apiJobResponse {
+	res := apiJobResponse{Job: job}
+	if job.State == JobQueued {
+		res.QueuePosition = s.queuePosition(job.ID)
+	}
+	return res
+}
+
+func (s *Service) HandleAPIJob(w http.ResponseWriter, r *http.Request) {
+	job := s.apiJob(w, r)
+	if job == nil {
+		return
+	}
+	apiJSON(w, 200, s.apiJobResponse(job))
+}
+
+// HandleAPIJobLog sends the job's log as plain text. It supports Range requests,
+// except for compressed logs, which are sent as they are if the client accepts
+// gzip. With `follow=1`, it keeps sending the log until the job finishes,
+// starting at byte `offset` if given.
+func (s *Service) HandleAPIJobLog(w http.ResponseWriter, r *http.Request) {
+	job := s.apiJob(w, r)
+	if job == nil {
+		return
+	}
+	if job.DeletedAt != nil {
+		apiError(w, 410, "log was deleted by the retention policy")
+		return
+	}
+
+	logPath := filepath.Join(s.config.DataDir, "logs", job.ID)
+	f, err := openLog(logPath)
+	if os.IsNotExist(err) {
+		apiError(w, 404, "job has no log yet")
+		return
+	} else if err != nil {
+		log.Printf("failed to open log file: %v", err)
+		apiError(w, 500, "failed to open log")
+		return
+	}
+	defer f.Close()
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+
+	if r.URL.Query().Get("follow") == "" {
+		if file, ok := f.(*os.File); ok {
+			stat, err := file.Stat()
+			if err != nil {
+				apiError(w, 500, "failed to stat log")
+				return
+			}
+			http.ServeContent(w, r, "", stat.ModTime(), file)
+			return
+		}
+
+		w.Header().Add("Vary", "Accept-Encoding")
+		if acceptsGzip(r) {
+			gz, err := os.Open(logPath + ".gz")
+			if err != nil {
+				log.Printf("failed to open log file: %v", err)
+				apiError(w, 500, "failed to open log")
+				return
+			}
+			defer gz.Close()
+			w.Header().Set("Content-Encoding", "gzip")
+			io.Copy(w, gz)
+			return
+		}
+		io.Copy(w, f)
+		return
+	}
+
+	var offset int64
+	if o := r.URL.Query().Get("offset"); o != "" {
+		offset, err = strconv.ParseInt(o, 10, 64)
+		if err != nil || offset < 0 {
+			apiError(w, 400, "invalid offset '%s'", o)
+			return
+		}
+	}
+
+	flusher, _ := w.(http.Flusher)
+	err = s.followLog(r.Context(), job.ID, offset, func(data []byte) error {
+		if _, err := w.Write(data); err != nil {
+			return err
+		}
+		if flusher != nil {
+			flusher.Flush()
+		}
+		return nil
+	})
+	if err != nil && r.Context().Err() == nil {
+		log.Printf("failed to follow log: %v", err)
+	}
+}
+
+type apiArtifact struct {
+	Path   string `json:"path"`
+	Size   int64  `json:"size"`
+	SHA256 string `json:"sha256"`
+	URL    string `json:"url"`
+}
+
+func (s *Service) HandleAPIJobArtifacts(w http.ResponseWriter, r *http.Request) {
+	job := s.apiJob(w, r)
+	if job == nil {
+		return
+	}
+
+	if gone := artifactsGone(job); gone != "" {
+		apiError(w, 410, "%s", gone)
+		return
+	}
+
+	files, err := s.artifacts.List(r.Context(), job.ID)
+	if err != nil {
+		log.Printf("failed to list artifacts: %v", err)
+		apiError(w, 500, "failed to list artifacts")
+		return
+	}
+	res := []apiArtifact{}
+	for _, file := range files {
+		res = append(res, apiArtifact{
+			Path:   file.Path,
+			Size:   file.Size,
+			SHA256: file.SHA256,
+			URL:    fmt.Sprintf("%s/jobs/%s/artifacts/%s", s.config.ExternalURL, job.ID, file.Path),
+		})
+	}
+	apiJSON(w, 200, map[string]any{"artifacts": res})
+}
+
+// acceptsGzip returns whether the request's Accept-Encoding allows gzip.
+func acceptsGzip(r *http.Request) bool {
+	for _, e := range strings.Split(r.Header.Get("Accept-Encoding"), ",") {
+		name, params, _ := strings.Cut(strings.TrimSpace(e), ";")
+		if strings.TrimSpace(name) == "gzip" && strings.ReplaceAll(params, " ", "") != "q=0" {
+			return true
+		}
+	}
+	return false
+}
+
+func fileSHA256(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+type apiTriggerRequest struct {
+	// owner/name
+	Repo string `json:"repo"`
+	// Run on the head of this branch, or of this PR. Exactly one must be set.
+	Branch string `json:"branch"`
+	PR     int    `json:"pr"`
+	// Only run this job. Empty means all jobs whose `## on` matches.
+	Job string `json:"job"`
+	// Extra attributes for `## on` conditions.
+	Attributes map[string]string `json:"attributes"`
+}
+
+// HandleAPITrigger runs the jobs for the head of a branch or a PR, like a push
+// or `bender run` would.
+func (s *Service) HandleAPITrigger(w http.ResponseWriter, r *http.Request) {
+	var req apiTriggerRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		apiError(w, 400, "invalid request: %v", err)
+		return
+	}
+	owner, name, ok := strings.Cut(req.Repo, "/")
+	if !ok || owner == "" || name == "" {
+		apiError(w, 400, "invalid repo '%s', must be owner/name", req.Repo)
+		return
+	}
+	if (req.Branch == "") == (req.PR == 0) {
+		apiError(w, 400, "exactly one of branch and pr must be set")
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), 60*time.Second)
+	defer cancel()
+
+	gh, installationID, err := s.repoGithubClient(ctx, owner, name)
+	if err != nil {
+		apiError(w, 404, "%v", err)
+		return
+	}
+	repo, _, err := gh.Repositories.Get(ctx, owner, name)
+	if err != nil {
+		apiError(w, 502, "failed to get repo: %v", err)
+		return
+	}
+
+	var event *Event
+	if req.PR != 0 {
+		pr, _, err := gh.PullRequests.Get(ctx, owner, name, req.PR)
+		if err != nil {
+			apiError(w, 502, "failed to get PR: %v", err)
+			return
+		}
+		event = s.pullRequestEvent(repo, pr, installationID)
+		event.ApprovedBy = "api"
+	} else {
+		branch, _, err := gh.Repositories.GetBranch(ctx, owner, name, req.Branch, true)
+		if err != nil {
+			apiError(w, 502, "failed to get branch: %v", err)
+			return
+		}
+		event = pushEvent(repo, req.Branch, *branch.Commit.SHA, installationID)
+		event.CloneURL = *repo.CloneURL
+	}
+	for k, v := range req.Attributes {
+		event.Attributes[k] = v
+	}
+
+	log.Printf("API trigger for %s %+v", req.Repo, req)
+	jobs, err := s.handleEvent(ctx, gh, event, req.Job)
+	if err != nil {
+		apiError(w, 400, "%v", err)
+		return
+	}
+
+	res := []apiJobResponse{}
+	for _, job := range jobs {
+		res = append(res, s.apiJobResponse(job))
+	}
+	apiJSON(w, 200, map[string]any{"jobs": res})
+}
+
+func (s *Service) HandleAPICancel(w http.ResponseWriter, r *http.Request) {
+	job := s.apiJob(w, r)
+	if job == nil {
+		return
+	}
+
+	count := s.cancelJobs(func(j *Job) bool {
+		return j.ID == job.ID
+	}, "cancelled via API")
+	if count == 0 {
+		apiError(w, 409, "job is %s, it can't be cancelled", job.State)
+		return
+	}
+	apiJSON(w, 200, map[string]any{"cancelled": true})
+}
@@ -0,0 +1,465 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/gzip"
+	"context"
+	"html/template"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Text artifacts bigger than this are truncated in previews.
+const artifactPreviewMaxSize = 1024 * 1024
+
+// Served artifacts are untrusted, HTML ones mustn't run scripts in bender's origin.
+const artifactsCSP = "sandbox allow-scripts allow-popups"
+
+// ArtifactFile is a file in a job's artifacts.
+type ArtifactFile struct {
+	// Relative to the artifacts root, with slashes.
+	Path    string      `json:"path"`
+	Size    int64       `json:"size"`
+	SHA256  string      `json:"sha256"`
+	Mode    os.FileMode `json:"mode"`
+	ModTime time.Time   `json:"mod_time"`
+}
+
+// listArtifactFiles returns the files in a local artifacts dir, sorted by path.
+func listArtifactFiles(dir string) ([]ArtifactFile, error) {
+	var res []ArtifactFile
+	err := filepath.Walk(dir, func(p string, info os.FileInfo, err error) error {
+		if os.IsNotExist(err) && p == dir {
+			return filepath.SkipDir
+		}
+		if err != nil || !info.Mode().IsRegular() {
+			return err
+		}
+
+		rel, err := filepath.Rel(dir, p)
+		if err != nil {
+			return err
+		}
+		hash, err := fileSHA256(p)
+		if err != nil {
+			return err
+		}
+		res = append(res, ArtifactFile{
+			Path:    filepath.ToSlash(rel),
+			Size:    info.Size(),
+			SHA256:  hash,
+			Mode:    info.Mode().Perm(),
+			ModTime: info.ModTime(),
+		})
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	// Walk goes in lexical order of each dir's entries, which isn't the
+	// order of the full paths: "a/b" is before "a.txt".
+	sort.Slice(res, func(i, j int) bool {
+		return res[i].Path < res[j].Path
+	})
+	return res, nil
+}
+
+type artifactEntry struct {
+	Name string
+	// Relative link, escaped. It starts with "./", so names with a colon
+	// aren't taken for a URL scheme.
+	Href string
+	Dir  bool
+	Size int64
+	// Only for files.
+	SHA256 string
+	// Only in previews.
+	Preview string
+}
+
+type artifactCrumb struct {
+	Name string
+	Href string
+}
+
+// artifactPreview returns how a file can be previewed, from its name and the
+// start of its content: "image", "html", "text", or "" if it can't.
+func artifactPreview(name string, head []byte) string {
+	// Like http.ServeContent picks the Content-Type.
+	ctype := mime.TypeByExtension(path.Ext(name))
+	if ctype == "" {
+		ctype = http.DetectContentType(head)
+	}
+	ctype, _, _ = strings.Cut(ctype, ";")
+	switch {
+	case strings.HasPrefix(ctype, "image/"):
+		return "image"
+	case ctype == "text/html":
+		return "html"
+	case strings.HasPrefix(ctype, "text/"), ctype == "application/json", ctype == "application/xml":
+		return "text"
+	}
+	return ""
+}
+
+// artifactEntries returns the files and dirs in an artifacts dir, dirs first.
+// files are all the artifacts, dir is the path of the dir with a trailing
+// slash, or "" for the root.
+func artifactEntries(files []ArtifactFile, dir string) []artifactEntry {
+	var res []artifactEntry
+	dirs := map[string]int{}
+	for _, file := range files {
+		rest, ok := strings.CutPrefix(file.Path, dir)
+		if !ok {
+			continue
+		}
+		name, _, isDir := strings.Cut(rest, "/")
+		if !isDir {
+			res = append(res, artifactEntry{
+				Name:   name,
+				Href:   "./" + url.PathEscape(name),
+				Size:   file.Size,
+				SHA256: file.SHA256,
+			})
+			continue
+		}
+		i, ok := dirs[name]
+		if !ok {
+			i = len(res)
+			dirs[name] = i
+			res = append(res, artifactEntry{
+				Name: name,
+				Href: "./" + url.PathEscape(name) + "/",
+				Dir:  true,
+			})
+		}
+		res[i].Size += file.Size
+	}
+	sort.SliceStable(res, func(i, j int) bool {
+		return res[i].Dir && !res[j].Dir
+	})
+	return res
+}
+
+// artifactCrumbs returns the links to the dirs in the path to an artifact,
+// starting with the artifacts root.
+func artifactCrumbs(jobID string, rel string) []artifactCrumb {
+	href := "/jobs/" + jobID + "/artifacts/"
+	res := []artifactCrumb{{Name: "artifacts", Href: href}}
+	for _, name := range strings.Split(strings.Trim(rel, "/"), "/") {
+		if name == "" {
+			continue
+		}
+		href += url.PathEscape(name) + "/"
+		res = append(res, artifactCrumb{Name: name, Href: href})
+	}
+	return res
+}
+
+var artifactIndexTemplate = template.Must(template.New("artifactIndex").Funcs(template.FuncMap{
+	"bytes": humanBytes,
+}).Parse(`
+{{define "header"}}
+<h1>
+	<a href="/">bender</a> /
+	<a href="/jobs/{{.JobID}}">{{if .Job}}{{.Job.Name}}{{else}}{{.JobID}}{{end}}</a>
+	{{range .Crumbs}} / <a href="{{.Href}}">{{.Name}}</a>{{end}}
+</h1>
+{{end}}
+
+{{define "style"}}
+<style type="text/css">
+	body { font-family: sans-serif; }
+	table { border-collapse: collapse; }
+	td, th { padding: 2px 8px; text-align: left; }
+	td.size { text-align: right; }
+	code { color: #666; }
+	pre { border: 1px solid #ddd; padding: 8px; overflow: auto; }
+	iframe { width: 100%; height: 80vh; border: 1px solid #ddd; }
+	img { max-width: 100%; }
+</style>
+{{end}}
+
+{{define "index"}}<!DOCTYPE html>
+<html>
+	<head>
+		<title>{{.Title}} - bender</title>
+		{{template "style"}}
+	</head>
+	<body>
+		{{template "header" .}}
+		<p>Download as <a href="?download=zip">.zip</a> or <a href="?download=tar.gz">.tar.gz</a></p>
+		<table>
+			<tr><th>Name</th><th>Size</th><th>SHA-256</th><th></th></tr>
+			{{range .Entries}}
+			<tr>
+				<td><a href="{{.Href}}">{{.Name}}{{if .Dir}}/{{end}}</a></td>
+				<td class="size">{{bytes .Size}}</td>
+				<td>{{if .SHA256}}<code>{{.SHA256}}</code>{{end}}</td>
+				<td>{{if not .Dir}}<a href="{{.Href}}?preview">preview</a>{{end}}</td>
+			</tr>
+			{{else}}
+			<tr><td colspan="4">No artifacts.</td></tr>
+			{{end}}
+		</table>
+	</body>
+</html>
+{{end}}
+
+{{define "preview"}}<!DOCTYPE html>
+<html>
+	<head>
+		<title>{{.Title}} - bender</title>
+		{{template "style"}}
+	</head>
+	<body>
+		{{template "header" .}}
+		{{with .Entry}}
+		<p>
+			{{bytes .Size}}, SHA-256 <code>{{.SHA256}}</code>.
+			<a href="{{.Href}}">Raw</a>
+			<a href="{{.Href}}" download>Download</a>
+		</p>
+		{{if eq .Preview "image"}}
+		<img src="{{.Href}}" alt="{{.Name}}">
+		{{else if eq .Preview "html"}}
+		<iframe sandbox="allow-scripts allow-popups" src="{{.Href}}"></iframe>
+		{{else if eq .Preview "text"}}
+		<pre>{{$.Text}}</pre>
+		{{if $.Truncated}}<p>Only the first {{bytes $.Truncated}} are shown.</p>{{end}}
+		{{else}}
+		<p>There's no preview for this file.</p>
+		{{end}}
+		{{end}}
+	</body>
+</html>
+{{end}}
+`))
+
+// serveArtifacts serves the artifacts of a job: an index of each dir, which
+// can be downloaded as a zip or tar.gz, and the files, raw or previewed.
+func (s *Service) serveArtifacts(w http.ResponseWriter, r *http.Request, job *Job, jobID string) {
+	files, err := s.artifacts.List(r.Context(), jobID)
+	if err != nil {
+		log.Printf("failed to list artifacts: %v", err)
+		http.Error(w, http.StatusText(500), 500)
+		return
+	}
+
+	rel := path.Clean("/" + strings.TrimPrefix(r.URL.Path, "/jobs/"+jobID+"/artifacts"))
+	name := strings.TrimPrefix(rel, "/")
+	var file *ArtifactFile
+	isDir := name == ""
+	for i := range files {
+		if files[i].Path == name {
+			file = &files[i]
+		} else if strings.HasPrefix(files[i].Path, name+"/") {
+			isDir = true
+		}
+	}
+	if file == nil && !isDir {
+		http.Error(w, http.StatusText(404), 404)
+		return
+	}
+
+	data := struct {
+		JobID     string
+		Job       *Job
+		Title     string
+		Crumbs    []artifactCrumb
+		Entries   []artifactEntry
+		Entry     *artifactEntry
+		Text      string
+		Truncated int64
+	}{
+		JobID:  jobID,
+		Job:    job,
+		Crumbs: artifactCrumbs(jobID, rel),
+	}
+	jobName := jobID
+	if job != nil {
+		jobName = job.Name
+	}
+	data.Title = "artifacts of " + jobName
+	if rel != "/" {
+		data.Title += " " + rel
+	}
+
+	if file == nil {
+		if !strings.HasSuffix(r.URL.Path, "/") {
+			u := url.URL{Path: path.Base(r.URL.Path) + "/", RawQuery: r.URL.RawQuery}
+			http.Redirect(w, r, u.String(), http.StatusMovedPermanently)
+			return
+		}
+
+		prefix := ""
+		if name != "" {
+			prefix = name + "/"
+		}
+		switch r.URL.Query().Get("download") {
+		case "":
+		case "zip", "tar.gz":
+			s.downloadArtifacts(w, r, files, prefix, jobID)
+			return
+		default:
+			http.Error(w, "download must be zip or tar.gz", 400)
+			return
+		}
+
+		data.Entries = artifactEntries(files, prefix)
+		w.Header().Add("Content-Type", "text/html; charset=utf-8")
+		if err := artifactIndexTemplate.ExecuteTemplate(w, "index", data); err != nil {
+			log.Printf("failed to render artifacts index: %v", err)
+		}
+		return
+	}
+
+	if !r.URL.Query().Has("preview") {
+		s.artifacts.ServeFile(w, r, jobID, *file)
+		return
+	}
+
+	// The crumbs are the dirs, the file is the page.
+	data.Crumbs = data.Crumbs[:len(data.Crumbs)-1]
+	base := path.Base(file.Path)
+	data.Entry = &artifactEntry{
+		Name:   base,
+		Href:   "./" + url.PathEscape(base),
+		Size:   file.Size,
+		SHA256: file.SHA256,
+	}
+	content, err := s.readArtifactPreview(r.Context(), jobID, *file)
+	if err != nil {
+		log.Printf("failed to preview artifact: %v", err)
+		http.Error(w, http.StatusText(500), 500)
+		return
+	}
+	head := content
+	if len(head) > 512 {
+		head = head[:512]
+	}
+	data.Entry.Preview = artifactPreview(base, head)
+	if data.Entry.Preview == "text" {
+		data.Text = strings.ToValidUTF8(string(content), "\uFFFD")
+		if file.Size > artifactPreviewMaxSize {
+			data.Truncated = artifactPreviewMaxSize
+		}
+	}
+	w.Header().Add("Content-Type", "text/html; charset=utf-8")
+	if err := artifactIndexTemplate.ExecuteTemplate(w, "preview", data); err != nil {
+		log.Printf("failed to render artifact preview: %v", err)
+	}
+}
+
+// readArtifactPreview reads the start of an artifact for its preview.
+func (s *Service) readArtifactPreview(ctx context.Context, jobID string, file ArtifactFile) ([]byte, error) {
+	f, err := s.artifacts.Open(ctx, jobID, file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return io.ReadAll(io.LimitReader(f, artifactPreviewMaxSize))
+}
+
+// downloadArtifacts streams the artifacts in a dir as a zip or tar.gz, as
+// asked by the `download` query parameter. prefix is the dir's path with a
+// trailing slash, or "" for the root.
+func (s *Service) downloadArtifacts(w http.ResponseWriter, r *http.Request, files []ArtifactFile, prefix string, jobID string) {
+	format := r.URL.Query().Get("download")
+	name := jobID
+	if prefix != "" {
+		name += "-" + strings.ReplaceAll(strings.TrimSuffix(prefix, "/"), "/", "-")
+	}
+	name += "." + format
+
+	var dirFiles []ArtifactFile
+	for _, file := range files {
+		if strings.HasPrefix(file.Path, prefix) {
+			dirFiles = append(dirFiles, file)
+		}
+	}
+	open := func(file ArtifactFile) (io.ReadCloser, error) {
+		return s.artifacts.Open(r.Context(), jobID, file)
+	}
+
+	w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": name}))
+	var err error
+	if format == "zip" {
+		w.Header().Set("Content-Type", "application/zip")
+		err = writeZip(w, dirFiles, prefix, open)
+	} else {
+		w.Header().Set("Content-Type", "application/gzip")
+		err = writeTarGz(w, dirFiles, prefix, open)
+	}
+	if err != nil {
+		// Too late for an error status, the download is cut short.
+		log.Printf("failed to send artifacts of job %s as %s: %v", jobID, format, err)
+	}
+}
+
+// copyArtifact copies an artifact to w.
+func copyArtifact(w io.Writer, file ArtifactFile, open func(ArtifactFile) (io.ReadCloser, error)) error {
+	f, err := open(file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = io.Copy(w, f)
+	return err
+}
+
+// writeZip writes files to a zip, with their paths without prefix.
+func writeZip(w io.Writer, files []ArtifactFile, prefix string, open func(ArtifactFile) (io.ReadCloser, error)) error {
+	zw := zip.NewWriter(w)
+	for _, file := range files {
+		hdr := &zip.FileHeader{
+			Name:     strings.TrimPrefix(file.Path, prefix),
+			Method:   zip.Deflate,
+			Modified: file.ModTime,
+		}
+		hdr.SetMode(file.Mode)
+		fw, err := zw.CreateHeader(hdr)
+		if err != nil {
+			return err
+		}
+		if err := copyArtifact(fw, file, open); err != nil {
+			return err
+		}
+	}
+	return zw.Close()
+}
+
+// writeTarGz writes files to a tar.gz, with their paths without prefix.
+func writeTarGz(w io.Writer, files []ArtifactFile, prefix string, open func(ArtifactFile) (io.ReadCloser, error)) error {
+	gw := gzip.NewWriter(w)
+	tw := tar.NewWriter(gw)
+	for _, file := range files {
+		err := tw.WriteHeader(&tar.Header{
+			Typeflag: tar.TypeReg,
+			Name:     strings.TrimPrefix(file.Path, prefix),
+			Size:     file.Size,
+			Mode:     int64(file.Mode.Perm()),
+			ModTime:  file.ModTime,
+		})
+		if err != nil {
+			return err
+		}
+		if err := copyArtifact(tw, file, open); err != nil {
+			return err
+		}
+	}
+	if err := tw.Close(); err != nil {
+		return err
+	}
+	return gw.Close()
+}
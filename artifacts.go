@@ -0,0 +1,299 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"html/template"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"golang.org/x/sys/unix"
+)
+
+const mb = 1024 * 1024
+
+// How long storing a job's artifacts can take. It's done while the job holds
+// its slot, so a hung store mustn't keep it forever.
+const artifactsPutTimeout = 30 * time.Minute
+
+// artifactsPolicy returns the artifacts policy for a repo.
+func (s *Service) artifactsPolicy(repo string) ArtifactsPolicy {
+	if p, ok := s.config.Artifacts.Repos[repo]; ok {
+		return p
+	}
+	return s.config.Artifacts.ArtifactsPolicy
+}
+
+// jobArtifacts is a job with artifacts, in the job_artifacts index.
+type jobArtifacts struct {
+	ID         string     `json:"-"`
+	Repo       string     `json:"repo"`
+	FinishedAt *time.Time `json:"finished_at,omitempty"`
+	// 0 for jobs from before sizes were recorded, until expireArtifacts checks them.
+	Size int64 `json:"size"`
+}
+
+// repoArtifactsSize returns the total size of the artifacts kept for a repo's jobs.
+func (s *Service) repoArtifactsSize(repo string) (int64, error) {
+	u, err := s.db.getArtifactsUsage(repo)
+	return u.Size, err
+}
+
+// hasArtifacts returns whether the job published artifacts that haven't been deleted.
+func (j *Job) hasArtifacts() bool {
+	return j.ArtifactsSize != 0 && j.ArtifactsExpiredAt == nil && j.DeletedAt == nil
+}
+
+// publishArtifacts stores the artifacts of a job from its home dir. If they're
+// over the size limits of the repo, they aren't kept, and the log says why.
+func (s *Service) publishArtifacts(job *Job, dir string, logs io.Writer) error {
+	size, err := dirSize(dir)
+	if err != nil {
+		return err
+	}
+	if size == 0 {
+		return nil
+	}
+
+	repo := *job.Repo.FullName
+	policy := s.artifactsPolicy(repo)
+	if policy.MaxJobSizeMB != 0 && size > int64(policy.MaxJobSizeMB)*mb {
+		fmt.Fprintf(logs, "artifacts are %s, more than the limit of %d MB, not keeping them\n", humanBytes(size), policy.MaxJobSizeMB)
+		return nil
+	}
+
+	// So concurrent jobs don't go over the repo quota together.
+	s.artifactsMutex.Lock()
+	if policy.MaxRepoSizeMB != 0 {
+		used, err := s.repoArtifactsSize(repo)
+		if err != nil {
+			s.artifactsMutex.Unlock()
+			return err
+		}
+		if used+size > int64(policy.MaxRepoSizeMB)*mb {
+			s.artifactsMutex.Unlock()
+			fmt.Fprintf(logs, "artifacts are %s, and %s already used by %s, more than its quota of %d MB, not keeping them\n", humanBytes(size), humanBytes(used), repo, policy.MaxRepoSizeMB)
+			return nil
+		}
+	}
+	// Now, so the size counts for the quota while they're stored, which can
+	// take a while.
+	job.ArtifactsSize = size
+	s.updateJob(job)
+	s.artifactsMutex.Unlock()
+
+	ctx, cancel := context.WithTimeout(context.Background(), artifactsPutTimeout)
+	defer cancel()
+	err = s.artifacts.Put(ctx, job.ID, dir)
+	if err != nil {
+		fmt.Fprintf(logs, "failed to store artifacts\n")
+		job.ArtifactsSize = 0
+		s.updateJob(job)
+		ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+		defer cancel()
+		if err := s.artifacts.Delete(ctx, job.ID); err != nil {
+			log.Printf("failed to delete partially stored artifacts of job %s: %v", job.ID, err)
+		}
+		return err
+	}
+	return nil
+}
+
+// expireArtifacts deletes the artifacts of jobs older than their repo's
+// artifacts policy allows.
+func (s *Service) expireArtifacts() {
+	entries, err := s.db.listJobArtifacts()
+	if err != nil {
+		log.Printf("failed to list jobs for artifact expiry: %v", err)
+		return
+	}
+
+	for _, a := range entries {
+		if a.Size == 0 {
+			// Jobs from before sizes were recorded, which kept artifacts in the data dir.
+			if err := s.checkArtifactsSize(a.ID); err != nil {
+				log.Printf("failed to check artifacts size of job %s: %v", a.ID, err)
+			}
+			continue
+		}
+
+		expire := s.artifactsPolicy(a.Repo).Expire
+		if a.FinishedAt == nil || expire == 0 || time.Since(*a.FinishedAt) <= expire {
+			continue
+		}
+		job, err := s.db.getJob(a.ID)
+		if err != nil || job == nil {
+			log.Printf("failed to get job %s for artifact expiry: %v", a.ID, err)
+			continue
+		}
+
+		log.Printf("deleting expired artifacts of job %s, finished at %v", job.ID, *a.FinishedAt)
+		if err := s.artifacts.Delete(context.Background(), job.ID); err != nil {
+			log.Printf("failed to delete artifacts of job %s: %v", job.ID, err)
+			continue
+		}
+		now := time.Now()
+		job.ArtifactsExpiredAt = &now
+		s.updateJob(job)
+	}
+}
+
+// checkArtifactsSize records the size of the artifacts of a job from before
+// sizes were recorded, so they count for the quota and expire.
+func (s *Service) checkArtifactsSize(jobID string) error {
+	size, err := dirSize(filepath.Join(s.config.DataDir, "artifacts", jobID))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if size == 0 {
+		return s.db.uncheckJobArtifacts(jobID)
+	}
+	job, err := s.db.getJob(jobID)
+	if err != nil {
+		return err
+	}
+	if job == nil {
+		return s.db.uncheckJobArtifacts(jobID)
+	}
+	job.ArtifactsSize = size
+	return s.db.saveJob(job)
+}
+
+// artifactsGone returns why the job's artifacts are no longer available, or "".
+func artifactsGone(job *Job) string {
+	if job.DeletedAt != nil {
+		return fmt.Sprintf("The artifacts were deleted on %s by the retention policy.", job.DeletedAt.UTC().Format("2006-01-02 15:04 UTC"))
+	}
+	if job.ArtifactsExpiredAt != nil {
+		return fmt.Sprintf("The artifacts expired on %s.", job.ArtifactsExpiredAt.UTC().Format("2006-01-02 15:04 UTC"))
+	}
+	return ""
+}
+
+type artifactsUsage struct {
+	Repo string `json:"repo"`
+	// Jobs with artifacts.
+	Jobs  int   `json:"jobs"`
+	Size  int64 `json:"size"`
+	Quota int64 `json:"quota,omitempty"`
+}
+
+type artifactsUsageSummary struct {
+	Repos []artifactsUsage `json:"repos"`
+	Total int64            `json:"total"`
+	// Free space in the data dir's filesystem.
+	Free int64 `json:"free"`
+}
+
+// artifactsUsage returns how much space the artifacts of each repo use, biggest first.
+func (s *Service) artifactsUsage() (*artifactsUsageSummary, error) {
+	repos, err := s.db.listArtifactsUsage()
+	if err != nil {
+		return nil, err
+	}
+
+	res := &artifactsUsageSummary{Repos: []artifactsUsage{}}
+	for _, u := range repos {
+		u.Quota = int64(s.artifactsPolicy(u.Repo).MaxRepoSizeMB) * mb
+		res.Repos = append(res.Repos, u)
+		res.Total += u.Size
+	}
+	sort.Slice(res.Repos, func(i, j int) bool {
+		return res.Repos[i].Size > res.Repos[j].Size
+	})
+
+	var stat unix.Statfs_t
+	if err := unix.Statfs(s.config.DataDir, &stat); err == nil {
+		res.Free = int64(stat.Bavail) * int64(stat.Bsize)
+	}
+	return res, nil
+}
+
+var artifactsTemplate = template.Must(template.New("artifacts").Funcs(template.FuncMap{
+	"bytes": humanBytes,
+}).Parse(`<!DOCTYPE html>
+<html>
+	<head>
+		<title>artifacts - bender</title>
+		<style type="text/css">
+			body { font-family: sans-serif; }
+			table { border-collapse: collapse; }
+			td, th { padding: 2px 8px; text-align: left; }
+		</style>
+	</head>
+	<body>
+		<h1><a href="/">bender</a> / artifacts</h1>
+		<table>
+			<tr><th>Repo</th><th>Jobs</th><th>Size</th><th>Quota</th></tr>
+			{{range .Repos}}
+			<tr><td><a href="/repos/{{.Repo}}">{{.Repo}}</a></td><td>{{.Jobs}}</td><td>{{bytes .Size}}</td><td>{{if .Quota}}{{bytes .Quota}}{{end}}</td></tr>
+			{{end}}
+			<tr><th>Total</th><th></th><th>{{bytes .Total}}</th><th></th></tr>
+		</table>
+		<p>{{bytes .Free}} free on disk.</p>
+	</body>
+</html>
+`))
+
+func (s *Service) HandleArtifactsUsage(w http.ResponseWriter, r *http.Request) {
+	usage, err := s.artifactsUsage()
+	if err != nil {
+		log.Printf("failed to get artifacts usage: %v", err)
+		http.Error(w, http.StatusText(500), 500)
+		return
+	}
+	w.Header().Add("Content-Type", "text/html; charset=utf-8")
+	if err := artifactsTemplate.Execute(w, usage); err != nil {
+		log.Printf("failed to render artifacts usage: %v", err)
+	}
+}
+
+func (s *Service) HandleAPIArtifactsUsage(w http.ResponseWriter, r *http.Request) {
+	usage, err := s.artifactsUsage()
+	if err != nil {
+		log.Printf("failed to get artifacts usage: %v", err)
+		apiError(w, 500, "failed to get artifacts usage")
+		return
+	}
+	apiJSON(w, 200, usage)
+}
+
+func (s *Service) HandleJobArtifacts(w http.ResponseWriter, r *http.Request) {
+	jobID := chi.URLParam(r, "jobID")
+	if !validJobID(jobID) {
+		log.Printf("invalid job ID: '%s'", jobID)
+		http.Error(w, http.StatusText(404), 404)
+		return
+	}
+
+	job, err := s.db.getJob(jobID)
+	if err != nil {
+		log.Printf("failed to get job: %v", err)
+	}
+	if job != nil {
+		if gone := artifactsGone(job); gone != "" {
+			w.Header().Add("Content-Type", "text/html; charset=utf-8")
+			w.WriteHeader(410)
+			fmt.Fprintf(w, `<!DOCTYPE html>
+<html>
+	<head>
+		<title>artifacts of %s - bender</title>
+	</head>
+	<body>
+		<div>%s</div>
+		<div><a href="/jobs/%s">Job log</a></div>
+	</body>
+</html>
+`, template.HTMLEscapeString(job.Name), template.HTMLEscapeString(gone), jobID)
+			return
+		}
+	}
+
+	s.serveArtifacts(w, r, job, jobID)
+}
@@ -0,0 +1,220 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/go-github/v52/github"
+)
+
+func TestPublishArtifacts(t *testing.T) {
+	dir := t.TempDir()
+	db, err := openDB(filepath.Join(dir, "db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.db.Close()
+	store, err := newFSArtifactStore(filepath.Join(dir, "artifacts"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &Service{db: db, artifacts: store, config: Config{
+		DataDir: dir,
+		Artifacts: ArtifactsConfig{
+			ArtifactsPolicy: ArtifactsPolicy{MaxJobSizeMB: 2, MaxRepoSizeMB: 3, Expire: time.Hour},
+		},
+	}}
+
+	publish := func(id string, size int) (*Job, string) {
+		job := &Job{
+			Event:     &Event{Repo: &github.Repository{FullName: github.String("foo/bar")}},
+			ID:        id,
+			State:     JobRunning,
+			CreatedAt: time.Now(),
+		}
+		home := filepath.Join(dir, "home-"+id)
+		if err := os.MkdirAll(home, 0700); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filepath.Join(home, "out.bin"), make([]byte, size), 0600); err != nil {
+			t.Fatal(err)
+		}
+		var logs bytes.Buffer
+		if err := s.publishArtifacts(job, home, &logs); err != nil {
+			t.Fatal(err)
+		}
+		return job, logs.String()
+	}
+
+	job, logs := publish("big", 3*mb)
+	if job.ArtifactsSize != 0 || !strings.Contains(logs, "more than the limit of 2 MB") {
+		t.Errorf("artifacts over the job limit: got size %d, log %q", job.ArtifactsSize, logs)
+	}
+	job, logs = publish("first", 2*mb)
+	if job.ArtifactsSize != 2*mb || logs != "" {
+		t.Errorf("artifacts within limits: got size %d, log %q", job.ArtifactsSize, logs)
+	}
+	list, err := store.List(context.Background(), "first")
+	if err != nil || len(list) != 1 || list[0].Path != "out.bin" || list[0].SHA256 == "" {
+		t.Errorf("artifacts list: got %+v, %v", list, err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "artifacts", "first.json")); err != nil {
+		t.Errorf("artifacts list wasn't saved: %v", err)
+	}
+	job, logs = publish("second", 2*mb)
+	if job.ArtifactsSize != 0 || !strings.Contains(logs, "quota of 3 MB") {
+		t.Errorf("artifacts over the repo quota: got size %d, log %q", job.ArtifactsSize, logs)
+	}
+
+	// Expire the first job's artifacts.
+	first, err := db.getJob("first")
+	if err != nil {
+		t.Fatal(err)
+	}
+	finishedAt := time.Now().Add(-2 * time.Hour)
+	first.State = JobSuccess
+	first.FinishedAt = &finishedAt
+	if err := db.saveJob(first); err != nil {
+		t.Fatal(err)
+	}
+	s.expireArtifacts()
+
+	first, err = db.getJob("first")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if first.ArtifactsExpiredAt == nil || first.hasArtifacts() {
+		t.Errorf("artifacts didn't expire")
+	}
+	for _, name := range []string{"first", "first.json"} {
+		if _, err := os.Stat(filepath.Join(dir, "artifacts", name)); !os.IsNotExist(err) {
+			t.Errorf("expired artifacts still exist: %v", err)
+		}
+	}
+	if used, err := s.repoArtifactsSize("foo/bar"); err != nil || used != 0 {
+		t.Errorf("repo artifacts size after expiry: got %d, %v, want 0", used, err)
+	}
+	job, logs = publish("third", 2*mb)
+	if job.ArtifactsSize != 2*mb || logs != "" {
+		t.Errorf("artifacts within limits after expiry: got size %d, log %q", job.ArtifactsSize, logs)
+	}
+}
+
+func TestArtifactArchives(t *testing.T) {
+	dir := t.TempDir()
+	files := map[string]string{
+		"report.txt":       "all good\n",
+		"sub/index.html":   "<html></html>",
+		"sub/deep/out.bin": "\x00\x01\x02",
+	}
+	for name, content := range files {
+		p := filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(p), 0700); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(p, []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	list, err := listArtifactFiles(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	open := func(file ArtifactFile) (io.ReadCloser, error) {
+		return os.Open(filepath.Join(dir, filepath.FromSlash(file.Path)))
+	}
+
+	var buf bytes.Buffer
+	if err := writeZip(&buf, list, "", open); err != nil {
+		t.Fatal(err)
+	}
+	zr, err := zip.NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := map[string]string{}
+	for _, f := range zr.File {
+		r, err := f.Open()
+		if err != nil {
+			t.Fatal(err)
+		}
+		content, err := io.ReadAll(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got[f.Name] = string(content)
+	}
+	checkArchive(t, "zip", got, files)
+
+	// A dir, with paths relative to it.
+	var sub []ArtifactFile
+	subFiles := map[string]string{}
+	for _, file := range list {
+		if rest, ok := strings.CutPrefix(file.Path, "sub/"); ok {
+			sub = append(sub, file)
+			subFiles[rest] = files[file.Path]
+		}
+	}
+	buf.Reset()
+	if err := writeTarGz(&buf, sub, "sub/", open); err != nil {
+		t.Fatal(err)
+	}
+	gr, err := gzip.NewReader(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tr := tar.NewReader(gr)
+	got = map[string]string{}
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		content, err := io.ReadAll(tr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got[hdr.Name] = string(content)
+	}
+	checkArchive(t, "tar.gz", got, subFiles)
+
+	entries := artifactEntries(list, "sub/")
+	if len(entries) != 2 || entries[0].Name != "deep" || !entries[0].Dir || entries[0].Size != 3 || entries[1].Name != "index.html" || entries[1].Href != "./index.html" {
+		t.Errorf("wrong entries in sub/: %+v", entries)
+	}
+
+	for name, want := range map[string]string{
+		"report.txt":       "text",
+		"sub/index.html":   "html",
+		"sub/deep/out.bin": "",
+	} {
+		if preview := artifactPreview(name, []byte(files[name])); preview != want {
+			t.Errorf("preview of %s: got %q, want %q", name, preview, want)
+		}
+	}
+}
+
+func checkArchive(t *testing.T, format string, got, want map[string]string) {
+	t.Helper()
+	if len(got) != len(want) {
+		t.Errorf("%s: got %d files, want %d", format, len(got), len(want))
+	}
+	for name, content := range want {
+		if got[name] != content {
+			t.Errorf("%s: %s is %q, want %q", format, name, got[name], content)
+		}
+	}
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+
+	"github.com/sqlbunny/errors"
+)
+
+// ArtifactStore keeps the artifacts of finished jobs.
+type ArtifactStore interface {
+	// Put stores the artifacts of a job from a local dir, which it can take
+	// over: the caller doesn't use it after.
+	Put(ctx context.Context, jobID string, dir string) error
+	// List returns the files in a job's artifacts, sorted by path. It's
+	// empty if the job has none.
+	List(ctx context.Context, jobID string) ([]ArtifactFile, error)
+	// Open opens a file in a job's artifacts.
+	Open(ctx context.Context, jobID string, file ArtifactFile) (io.ReadCloser, error)
+	// ServeFile responds to r with a file in a job's artifacts, or with a
+	// redirect to where it can be downloaded from.
+	ServeFile(w http.ResponseWriter, r *http.Request, jobID string, file ArtifactFile)
+	// Delete deletes a job's artifacts, if it has any.
+	Delete(ctx context.Context, jobID string) error
+}
+
+func newArtifactStore(config Config) (ArtifactStore, error) {
+	switch config.Artifacts.Store.Type {
+	case "", "filesystem":
+		return newFSArtifactStore(filepath.Join(config.DataDir, "artifacts"))
+	case "s3":
+		return newS3ArtifactStore(config.Artifacts.Store.S3)
+	default:
+		return nil, errors.Errorf("invalid artifacts store type '%s', must be 'filesystem' or 's3'", config.Artifacts.Store.Type)
+	}
+}
+
+// fsArtifactStore keeps each job's artifacts in a dir named after the job, and
+// the list of files with their hashes in "<jobID>.json", so they're only
+// hashed once.
+type fsArtifactStore struct {
+	dir string
+}
+
+func newFSArtifactStore(dir string) (*fsArtifactStore, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	return &fsArtifactStore{dir: dir}, nil
+}
+
+func (st *fsArtifactStore) path(jobID string, file string) string {
+	return filepath.Join(st.dir, jobID, filepath.FromSlash(file))
+}
+
+func (st *fsArtifactStore) listPath(jobID string) string {
+	return filepath.Join(st.dir, jobID+".json")
+}
+
+func (st *fsArtifactStore) Put(ctx context.Context, jobID string, dir string) error {
+	files, err := listArtifactFiles(dir)
+	if err != nil {
+		return err
+	}
+	if err := os.Rename(dir, filepath.Join(st.dir, jobID)); err != nil {
+		return err
+	}
+	// Last, so artifacts are only listed when they're all stored.
+	return st.saveList(jobID, files)
+}
+
+func (st *fsArtifactStore) saveList(jobID string, files []ArtifactFile) error {
+	list, err := json.Marshal(files)
+	if err != nil {
+		return err
+	}
+	tmp := st.listPath(jobID) + ".tmp"
+	if err := os.WriteFile(tmp, list, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, st.listPath(jobID))
+}
+
+func (st *fsArtifactStore) List(ctx context.Context, jobID string) ([]ArtifactFile, error) {
+	list, err := os.ReadFile(st.listPath(jobID))
+	if os.IsNotExist(err) {
+		// Stored before lists were, list them now.
+		files, err := listArtifactFiles(filepath.Join(st.dir, jobID))
+		if err != nil || len(files) == 0 {
+			return files, err
+		}
+		if err := st.saveList(jobID, files); err != nil {
+			log.Printf("failed to save artifacts list of job %s: %v", jobID, err)
+		}
+		return files, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	var files []ArtifactFile
+	if err := json.Unmarshal(list, &files); err != nil {
+		return nil, errors.Errorf("invalid artifacts list of job %s: %w", jobID, err)
+	}
+	return files, nil
+}
+
+func (st *fsArtifactStore) Open(ctx context.Context, jobID string, file ArtifactFile) (io.ReadCloser, error) {
+	return os.Open(st.path(jobID, file.Path))
+}
+
+func (st *fsArtifactStore) ServeFile(w http.ResponseWriter, r *http.Request, jobID string, file ArtifactFile) {
+	f, err := os.Open(st.path(jobID, file.Path))
+	if os.IsNotExist(err) {
+		http.Error(w, http.StatusText(404), 404)
+		return
+	} else if err != nil {
+		log.Printf("failed to open artifact: %v", err)
+		http.Error(w, http.StatusText(500), 500)
+		return
+	}
+	defer f.Close()
+	w.Header().Set("Content-Security-Policy", artifactsCSP)
+	http.ServeContent(w, r, path.Base(file.Path), file.ModTime, f)
+}
+
+func (st *fsArtifactStore) Delete(ctx context.Context, jobID string) error {
+	if err := os.RemoveAll(filepath.Join(st.dir, jobID)); err != nil {
+		return err
+	}
+	if err := os.Remove(st.listPath(jobID)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
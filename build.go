@@ -0,0 +1,373 @@
+package main
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/containerd/containerd"
+	"github.com/containerd/containerd/cio"
+	"github.com/containerd/containerd/images"
+	"github.com/containerd/containerd/namespaces"
+	"github.com/containerd/containerd/oci"
+	"github.com/google/go-github/v52/github"
+	"github.com/opencontainers/runtime-spec/specs-go"
+	"github.com/sqlbunny/errors"
+)
+
+// Build contexts bigger than this aren't extracted.
+const buildContextMaxSize = 1024 * 1024 * 1024
+
+// Built images are named with this prefix, and labeled with when a job last
+// used them, in unix seconds.
+const (
+	builtImagePrefix    = "bender.local/build/"
+	builtImageUsedLabel = "bender.last-used"
+)
+
+// buildImage builds the job's Dockerfile into an image in the bender namespace
+// and returns its ref. The build context is the Dockerfile's dir in the repo.
+// Images are keyed by the dir's git tree hash, so it's only rebuilt when
+// something in it changes.
+//
+// The build runs with kaniko in a container in the jobs cgroup, so it's subject
+// to the same network sandbox as jobs.
+//
+// ctx must have the containerd namespace set. If jobCtx is done, the build is killed.
+func (s *Service) buildImage(jobCtx context.Context, ctx context.Context, job *Job, gh *github.Client, jobDir string, logs io.Writer) (string, error) {
+	dockerfile := path.Clean(job.Dockerfile)
+	contextPath := path.Dir(dockerfile)
+	tree, err := s.repoTreeSHA(jobCtx, gh, job, contextPath)
+	if err != nil {
+		return "", errors.Errorf("failed to get Dockerfile '%s': %w", job.Dockerfile, err)
+	}
+
+	hash := sha256.Sum256([]byte(tree + "\x00" + path.Base(dockerfile)))
+	tag := hex.EncodeToString(hash[:])[:16]
+	// Untrusted builds can't poison the images used by trusted jobs, which get secrets.
+	if !job.Trusted {
+		tag += "-untrusted"
+	}
+	ref := fmt.Sprintf("%s%s/%s:%s", builtImagePrefix, *job.Repo.Owner.Login, *job.Repo.Name, tag)
+
+	// One build per image at a time, so concurrent jobs wait for the same
+	// image instead of building it twice.
+	unlock, err := s.builds.lock(jobCtx, ref)
+	if err != nil {
+		return "", err
+	}
+	defer unlock()
+
+	if _, err := s.containerd.GetImage(ctx, ref); err == nil {
+		fmt.Fprintf(logs, "using image %s built from %s\n", ref, job.Dockerfile)
+		s.markBuiltImageUsed(ctx, ref)
+		return ref, nil
+	}
+
+	fmt.Fprintf(logs, "building image %s from %s\n", ref, job.Dockerfile)
+
+	buildDir := filepath.Join(jobDir, "build")
+	contextDir := filepath.Join(buildDir, "context")
+	outDir := filepath.Join(buildDir, "out")
+	for _, dir := range []string{contextDir, outDir} {
+		err = os.MkdirAll(dir, 0700)
+		if err != nil {
+			return "", err
+		}
+	}
+	err = s.fetchBuildContext(jobCtx, gh, job, contextPath, contextDir)
+	if err != nil {
+		return "", errors.Errorf("failed to get build context: %w", err)
+	}
+
+	builder, _, err := s.getImage(namespaces.WithNamespace(jobCtx, "bender"), s.config.ImageBuilder)
+	if err != nil {
+		return "", errors.Errorf("failed to get image builder: %w", err)
+	}
+
+	name := fmt.Sprintf("job-%s-build", job.ID)
+	cgroup, err := s.cgroup.createJob(name, s.jobResources(job))
+	if err != nil {
+		return "", err
+	}
+	container, err := s.containerd.NewContainer(ctx, name,
+		containerd.WithNewSnapshot(name+"-rootfs", builder),
+		containerd.WithNewSpec(
+			oci.WithProcessArgs("/kaniko/executor",
+				"--dockerfile=/workspace/"+path.Base(dockerfile),
+				"--context=dir:///workspace",
+				"--no-push",
+				"--destination="+ref,
+				"--tar-path=/out/image.tar",
+			),
+			oci.WithDefaultPathEnv,
+			oci.WithCgroup(cgroup),
+			oci.WithHostNamespace(specs.NetworkNamespace),
+			oci.WithMounts([]specs.Mount{
+				{
+					Type:        "none",
+					Source:      contextDir,
+					Destination: "/workspace",
+					Options:     []string{"rbind", "ro"},
+				},
+				{
+					Type:        "none",
+					Source:      outDir,
+					Destination: "/out",
+					Options:     []string{"rbind"},
+				},
+				s.resolvConfMount(),
+			}),
+		),
+	)
+	if err != nil {
+		return "", err
+	}
+	defer container.Delete(ctx, containerd.WithSnapshotCleanup)
+
+	task, err := container.NewTask(ctx, cio.NewCreator(
+		cio.WithFIFODir(filepath.Join(s.config.DataDir, "fifo")),
+		cio.WithStreams(nil, logs, logs),
+	))
+	if err != nil {
+		return "", err
+	}
+	defer task.Delete(ctx)
+	defer task.Kill(ctx, syscall.SIGKILL)
+
+	statusC, err := task.Wait(ctx)
+	if err != nil {
+		return "", err
+	}
+	err = task.Start(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	var status containerd.ExitStatus
+	select {
+	case status = <-statusC:
+	case <-jobCtx.Done():
+		task.Kill(ctx, syscall.SIGKILL)
+		<-statusC
+		return "", context.Cause(jobCtx)
+	}
+	if err := status.Error(); err != nil {
+		return "", err
+	}
+	if status.ExitCode() != 0 {
+		return "", errors.Errorf("image build exited with code %d", status.ExitCode())
+	}
+
+	f, err := os.Open(filepath.Join(outDir, "image.tar"))
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	imgs, err := s.containerd.Import(ctx, f)
+	if err != nil {
+		return "", errors.Errorf("failed to import built image: %w", err)
+	}
+	for _, img := range imgs {
+		log.Printf("unpacking built image %s", img.Name)
+		err = containerd.NewImage(s.containerd, img).Unpack(ctx, containerd.DefaultSnapshotter)
+		if err != nil {
+			return "", errors.Errorf("failed to unpack built image: %w", err)
+		}
+	}
+
+	if _, err := s.containerd.GetImage(ctx, ref); err != nil {
+		return "", errors.Errorf("built image %s not found after import: %w", ref, err)
+	}
+	s.markBuiltImageUsed(ctx, ref)
+	fmt.Fprintf(logs, "built image %s\n", ref)
+	return ref, nil
+}
+
+// markBuiltImageUsed records that a job uses a built image now, so
+// deleteUnusedBuiltImages keeps it. ctx must have the containerd namespace set.
+func (s *Service) markBuiltImageUsed(ctx context.Context, ref string) {
+	_, err := s.containerd.ImageService().Update(ctx, images.Image{
+		Name:   ref,
+		Labels: map[string]string{builtImageUsedLabel: strconv.FormatInt(time.Now().Unix(), 10)},
+	}, "labels."+builtImageUsedLabel)
+	if err != nil {
+		log.Printf("failed to mark built image %s as used: %v", ref, err)
+	}
+}
+
+// builtImageLastUsed returns when a job last used a built image.
+func builtImageLastUsed(img images.Image) time.Time {
+	if t, err := strconv.ParseInt(img.Labels[builtImageUsedLabel], 10, 64); err == nil {
+		return time.Unix(t, 0)
+	}
+	// Built before images were labeled.
+	return img.UpdatedAt
+}
+
+// deleteUnusedBuiltImages deletes the built images that no job used for
+// `built_images_expire`. Jobs mark them as used when they start and finish,
+// so running jobs' images are kept unless they run for longer than that.
+func (s *Service) deleteUnusedBuiltImages() {
+	expire := s.config.BuiltImagesExpire
+	if expire == 0 {
+		return
+	}
+	ctx := namespaces.WithNamespace(context.Background(), "bender")
+	imgs, err := s.containerd.ImageService().List(ctx)
+	if err != nil {
+		log.Printf("failed to list images: %v", err)
+		return
+	}
+
+	for _, img := range imgs {
+		if !strings.HasPrefix(img.Name, builtImagePrefix) || time.Since(builtImageLastUsed(img)) <= expire {
+			continue
+		}
+		// Not while a job is building it or starting to use it.
+		unlock, err := s.builds.lock(ctx, img.Name)
+		if err != nil {
+			continue
+		}
+		img, err := s.containerd.ImageService().Get(ctx, img.Name)
+		if err == nil && time.Since(builtImageLastUsed(img)) > expire {
+			log.Printf("deleting built image %s, last used at %v", img.Name, builtImageLastUsed(img))
+			if err := s.containerd.ImageService().Delete(ctx, img.Name); err != nil {
+				log.Printf("failed to delete built image %s: %v", img.Name, err)
+			}
+		}
+		unlock()
+	}
+}
+
+// repoTreeSHA returns the git tree hash of a dir in the repo at the job's SHA.
+func (s *Service) repoTreeSHA(ctx context.Context, gh *github.Client, job *Job, dir string) (string, error) {
+	owner, repo := *job.Repo.Owner.Login, *job.Repo.Name
+	if dir == "." {
+		commit, _, err := gh.Git.GetCommit(ctx, owner, repo, job.SHA)
+		if err != nil {
+			return "", err
+		}
+		return commit.GetTree().GetSHA(), nil
+	}
+
+	parent := path.Dir(dir)
+	if parent == "." {
+		parent = ""
+	}
+	_, entries, _, err := gh.Repositories.GetContents(ctx, owner, repo, parent, &github.RepositoryContentGetOptions{
+		Ref: job.SHA,
+	})
+	if err != nil {
+		return "", err
+	}
+	for _, entry := range entries {
+		if entry.GetName() == path.Base(dir) && entry.GetType() == "dir" {
+			return entry.GetSHA(), nil
+		}
+	}
+	return "", errors.Errorf("dir '%s' not found", dir)
+}
+
+// fetchBuildContext extracts a dir of the repo at the job's SHA into contextDir.
+func (s *Service) fetchBuildContext(ctx context.Context, gh *github.Client, job *Job, dir string, contextDir string) error {
+	u, _, err := gh.Repositories.GetArchiveLink(ctx, *job.Repo.Owner.Login, *job.Repo.Name, github.Tarball, &github.RepositoryContentGetOptions{
+		Ref: job.SHA,
+	}, false)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, "GET", u.String(), nil)
+	if err != nil {
+		return err
+	}
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != 200 {
+		return errors.Errorf("failed to download repo archive: %s", res.Status)
+	}
+
+	prefix := ""
+	if dir != "." {
+		prefix = dir + "/"
+	}
+	return extractBuildContext(res.Body, prefix, contextDir)
+}
+
+// extractBuildContext extracts the files under prefix in a GitHub repo tarball
+// into dir. Symlinks are skipped, so nothing can be written outside dir.
+func extractBuildContext(r io.Reader, prefix string, dir string) error {
+	gr, err := gzip.NewReader(r)
+	if err != nil {
+		return err
+	}
+	tr := tar.NewReader(gr)
+	var size int64
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		// The archive has everything in a "<owner>-<repo>-<sha>/" dir.
+		_, name, _ := strings.Cut(hdr.Name, "/")
+		name, ok := strings.CutPrefix(name, prefix)
+		if !ok || name == "" {
+			continue
+		}
+		if name != path.Clean(name) || path.IsAbs(name) || name == ".." || strings.HasPrefix(name, "../") {
+			return errors.Errorf("invalid path '%s' in repo archive", hdr.Name)
+		}
+		p := filepath.Join(dir, filepath.FromSlash(name))
+
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			if err := os.MkdirAll(p, 0755); err != nil {
+				return err
+			}
+		case tar.TypeReg:
+			size += hdr.Size
+			if size > buildContextMaxSize {
+				return errors.Errorf("build context is bigger than %d MB", buildContextMaxSize/mb)
+			}
+			mode := os.FileMode(0644)
+			if hdr.Mode&0111 != 0 {
+				mode = 0755
+			}
+			if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+				return err
+			}
+			f, err := os.OpenFile(p, os.O_WRONLY|os.O_CREATE|os.O_EXCL, mode)
+			if err != nil {
+				return err
+			}
+			_, err = io.Copy(f, tr)
+			if closeErr := f.Close(); err == nil {
+				err = closeErr
+			}
+			if err != nil {
+				return err
+			}
+		}
+	}
+}
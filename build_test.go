@@ -0,0 +1,87 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/containerd/containerd/images"
+)
+
+func TestExtractBuildContext(t *testing.T) {
+	var buf bytes.Buffer
+	gw := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(gw)
+	for _, hdr := range []*tar.Header{
+		{Typeflag: tar.TypeXGlobalHeader, Name: "pax_global_header"},
+		{Typeflag: tar.TypeDir, Name: "foo-bar-abc/", Mode: 0755},
+		{Typeflag: tar.TypeReg, Name: "foo-bar-abc/README.md", Mode: 0644, Size: 5},
+		{Typeflag: tar.TypeDir, Name: "foo-bar-abc/image/", Mode: 0755},
+		{Typeflag: tar.TypeReg, Name: "foo-bar-abc/image/Dockerfile", Mode: 0644, Size: 5},
+		{Typeflag: tar.TypeReg, Name: "foo-bar-abc/image/bin/tool", Mode: 0755, Size: 5},
+		{Typeflag: tar.TypeSymlink, Name: "foo-bar-abc/image/etc", Linkname: "/etc"},
+		{Typeflag: tar.TypeReg, Name: "foo-bar-abc/image2/Dockerfile", Mode: 0644, Size: 5},
+	} {
+		if err := tw.WriteHeader(hdr); err != nil {
+			t.Fatal(err)
+		}
+		if hdr.Size != 0 {
+			tw.Write([]byte("hello"))
+		}
+	}
+	tw.Close()
+	gw.Close()
+
+	dir := t.TempDir()
+	if err := extractBuildContext(&buf, "image/", dir); err != nil {
+		t.Fatal(err)
+	}
+
+	var got []string
+	filepath.Walk(dir, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			t.Fatal(err)
+		}
+		if p == dir {
+			return nil
+		}
+		rel, _ := filepath.Rel(dir, p)
+		kind := "file"
+		if info.IsDir() {
+			kind = "dir"
+		} else if info.Mode()&0100 != 0 {
+			kind = "executable"
+		}
+		got = append(got, rel+" "+kind)
+		return nil
+	})
+	want := []string{
+		"Dockerfile file",
+		"bin dir",
+		"bin/tool executable",
+	}
+	if len(got) != len(want) {
+		t.Fatalf("got %q, want %q", got, want)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Fatalf("got %q, want %q", got, want)
+		}
+	}
+}
+
+func TestBuiltImageLastUsed(t *testing.T) {
+	updated := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	img := images.Image{Name: builtImagePrefix + "foo/bar:abc", UpdatedAt: updated}
+	if got := builtImageLastUsed(img); !got.Equal(updated) {
+		t.Errorf("unlabeled image: got %v, want %v", got, updated)
+	}
+	img.Labels = map[string]string{builtImageUsedLabel: "1700000000"}
+	if got := builtImageLastUsed(img); !got.Equal(time.Unix(1700000000, 0)) {
+		t.Errorf("labeled image: got %v", got)
+	}
+}
@@ -13,6 +13,7 @@ func (s *Service) cacheGCRun() {
 	for {
 		time.Sleep(20 * time.Second)
 		s.deleteOldestCache()
+		s.deleteUnusedBuiltImages()
 	}
 }
 
@@ -2,9 +2,14 @@ package main
 
 import (
 	"fmt"
+	"log"
 	"os"
 	"path/filepath"
+	"strconv"
 	"strings"
+
+	"github.com/sqlbunny/errors"
+	"gopkg.in/yaml.v3"
 )
 
 type Cgroup struct {
@@ -46,5 +51,144 @@ func initCgroup() Cgroup {
 		panic(err)
 	}
 
+	// enable the controllers for job cgroups. This only works now that
+	// there are no processes left in the root cgroup.
+	for _, dir := range []string{cg.root, cg.jobs} {
+		for _, controller := range []string{"cpu", "io", "memory", "pids"} {
+			err = os.WriteFile(filepath.Join(cg.mountpoint, dir, "cgroup.subtree_control"), []byte("+"+controller), 0777)
+			if err != nil {
+				log.Printf("failed to enable cgroup controller %s in %s: %v", controller, dir, err)
+			}
+		}
+	}
+
 	return cg
 }
+
+// ByteSize is a size in bytes. In the config and directives it can be written
+// with a K, M, G or T suffix, in powers of 1024.
+type ByteSize int64
+
+func parseByteSize(s string) (ByteSize, error) {
+	mult := int64(1)
+	for i, suffix := range []string{"K", "M", "G", "T"} {
+		if n, ok := strings.CutSuffix(s, suffix); ok {
+			s = n
+			mult = 1 << (10 * (i + 1))
+			break
+		}
+	}
+
+	n, err := strconv.ParseInt(s, 10, 64)
+	if err != nil || n < 0 {
+		return 0, errors.Errorf("invalid size '%s'", s)
+	}
+	return ByteSize(n * mult), nil
+}
+
+func (b *ByteSize) UnmarshalYAML(value *yaml.Node) error {
+	n, err := parseByteSize(value.Value)
+	if err != nil {
+		return err
+	}
+	*b = n
+	return nil
+}
+
+func (b ByteSize) String() string {
+	for i, suffix := range []string{"T", "G", "M", "K"} {
+		unit := int64(1) << (10 * (4 - i))
+		if b != 0 && int64(b)%unit == 0 {
+			return fmt.Sprintf("%d%s", int64(b)/unit, suffix)
+		}
+	}
+	return fmt.Sprint(int64(b))
+}
+
+// Resources are limits for a job's cgroup. Zero means no limit.
+type Resources struct {
+	// Number of CPUs, can be fractional.
+	CPU    float64  `yaml:"cpu" json:"cpu,omitempty"`
+	Memory ByteSize `yaml:"memory" json:"memory,omitempty"`
+	Pids   int64    `yaml:"pids" json:"pids,omitempty"`
+}
+
+// merge returns r with the zero fields taken from def, capped to max.
+func (r Resources) merge(def Resources, max Resources) Resources {
+	if r.CPU == 0 {
+		r.CPU = def.CPU
+	}
+	if r.Memory == 0 {
+		r.Memory = def.Memory
+	}
+	if r.Pids == 0 {
+		r.Pids = def.Pids
+	}
+
+	if max.CPU != 0 && (r.CPU == 0 || r.CPU > max.CPU) {
+		r.CPU = max.CPU
+	}
+	if max.Memory != 0 && (r.Memory == 0 || r.Memory > max.Memory) {
+		r.Memory = max.Memory
+	}
+	if max.Pids != 0 && (r.Pids == 0 || r.Pids > max.Pids) {
+		r.Pids = max.Pids
+	}
+	return r
+}
+
+// createJob creates a cgroup for a job container with the given limits,
+// and returns its path for the OCI spec.
+func (cg *Cgroup) createJob(name string, res Resources) (string, error) {
+	path := filepath.Join(cg.jobs, name)
+	dir := filepath.Join(cg.mountpoint, path)
+	err := os.Mkdir(dir, 0777)
+	if err != nil && !os.IsExist(err) {
+		return "", err
+	}
+
+	const cpuPeriod = 100000
+	files := map[string]string{
+		"cpu.max":     "max",
+		"memory.max":  "max",
+		"memory.high": "max",
+		"pids.max":    "max",
+	}
+	if res.CPU != 0 {
+		files["cpu.max"] = fmt.Sprintf("%d %d", int64(res.CPU*cpuPeriod), cpuPeriod)
+	}
+	if res.Memory != 0 {
+		files["memory.max"] = fmt.Sprint(int64(res.Memory))
+		// Start throttling and reclaiming a bit before the hard limit,
+		// so jobs slow down instead of getting OOM-killed right away.
+		files["memory.high"] = fmt.Sprint(int64(res.Memory) / 10 * 9)
+	}
+	if res.Pids != 0 {
+		files["pids.max"] = fmt.Sprint(res.Pids)
+	}
+
+	for file, value := range files {
+		err := os.WriteFile(filepath.Join(dir, file), []byte(value), 0)
+		if err != nil {
+			return "", errors.Errorf("failed to write %s: %w", file, err)
+		}
+	}
+
+	return path, nil
+}
+
+// oomKilled returns whether any process in the given cgroup was killed by the OOM killer.
+func (cg *Cgroup) oomKilled(path string) bool {
+	events, err := os.ReadFile(filepath.Join(cg.mountpoint, path, "memory.events"))
+	if err != nil {
+		log.Printf("failed to read memory.events: %v", err)
+		return false
+	}
+
+	for _, line := range strings.Split(string(events), "\n") {
+		if count, ok := strings.CutPrefix(line, "oom_kill "); ok {
+			return count != "0"
+		}
+	}
+	return false
+}
@@ -0,0 +1,376 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/google/go-github/v52/github"
+	"github.com/sqlbunny/errors"
+)
+
+// How much of the end of the log goes in the check run summary.
+const (
+	logTailLines = 50
+	logTailBytes = 32 * 1024
+)
+
+// Limits of the check run summary. Section names come from the job's output,
+// so they could make it as long as they want.
+const (
+	// GitHub rejects longer summaries.
+	checkRunSummaryMaxSize = 65535
+	checkRunMaxSections    = 50
+	// In characters.
+	checkRunMaxSectionName = 100
+)
+
+// jobConclusion returns the check run conclusion and a description for a
+// job that finished with err.
+func jobConclusion(err error) (string, string) {
+	var cancelErr *cancelError
+	var timeoutErr *timeoutError
+	var oomErr *oomError
+	switch {
+	case err == nil:
+		return "success", ""
+	case errors.As(err, &cancelErr):
+		return "cancelled", fmt.Sprintf("Cancelled: %v", err)
+	case errors.As(err, &timeoutErr):
+		return "timed_out", fmt.Sprintf("Timed out after %v", timeoutErr.timeout)
+	case errors.As(err, &oomErr):
+		return "failure", fmt.Sprintf("Out of memory, limit is %v", oomErr.limit)
+	case errors.Is(err, errInterrupted):
+		return "failure", "Interrupted by bender restart"
+	default:
+		return "failure", ""
+	}
+}
+
+// reportJob reports the job's current state to GitHub, as a check run or, with
+// `use_statuses`, as a commit status. err is the error the job finished with,
+// it's ignored if the job isn't finished.
+func (s *Service) reportJob(ctx context.Context, gh *github.Client, job *Job, err error) error {
+	conclusion := ""
+	description := ""
+	switch job.State {
+	case JobQueued:
+		description = "Queued"
+	case JobRunning:
+		description = "Running"
+	case JobAwaitingApproval:
+		description = fmt.Sprintf("Awaiting approval, a maintainer must comment `bender approve %.7s`", job.SHA)
+	default:
+		conclusion, description = jobConclusion(err)
+	}
+
+	if s.config.UseStatuses {
+		state := "pending"
+		switch conclusion {
+		case "":
+		case "success":
+			state = "success"
+		case "failure", "timed_out":
+			state = "failure"
+		default:
+			state = "error"
+		}
+		err := s.setStatus(ctx, gh, job, state, description)
+		if err != nil {
+			return err
+		}
+
+		// Without check runs there are no annotations, comment on the PR diff
+		// instead. Not for cancelled jobs, like ones superseded by a new push:
+		// they'd comment on every push.
+		if conclusion == "failure" || conclusion == "timed_out" {
+			problems, err := s.jobProblems(job)
+			if err != nil {
+				log.Printf("failed to match problems in log: %v", err)
+			}
+			err = s.postProblemsReview(ctx, gh, job, problems)
+			if err != nil {
+				log.Printf("failed to post problems review: %v", err)
+			}
+		}
+		return nil
+	}
+
+	return s.setCheckRun(ctx, gh, job, conclusion, description)
+}
+
+func (s *Service) setStatus(ctx context.Context, gh *github.Client, j *Job, state string, description string) error {
+	url := fmt.Sprintf("%s/jobs/%s", s.config.ExternalURL, j.ID)
+	status := &github.RepoStatus{
+		State:     github.String(state),
+		Context:   github.String(fmt.Sprintf("ci/%s", j.Name)),
+		TargetURL: &url,
+	}
+	if description != "" {
+		status.Description = github.String(description)
+	}
+	_, _, err := gh.Repositories.CreateStatus(ctx,
+		*j.Repo.Owner.Login,
+		*j.Repo.Name,
+		j.SHA,
+		status)
+	return err
+}
+
+// go-github's UpdateCheckRunOptions is missing started_at.
+type updateCheckRunOptions struct {
+	github.UpdateCheckRunOptions
+	StartedAt *github.Timestamp `json:"started_at,omitempty"`
+}
+
+// setCheckRun creates the job's check run, or updates it if it already has one.
+// conclusion is empty if the job isn't finished.
+func (s *Service) setCheckRun(ctx context.Context, gh *github.Client, job *Job, conclusion string, description string) error {
+	owner := *job.Repo.Owner.Login
+	repo := *job.Repo.Name
+	url := fmt.Sprintf("%s/jobs/%s", s.config.ExternalURL, job.ID)
+
+	status := "queued"
+	if job.State == JobRunning {
+		status = "in_progress"
+	}
+	var startedAt, completedAt *github.Timestamp
+	if job.StartedAt != nil {
+		startedAt = &github.Timestamp{Time: *job.StartedAt}
+	}
+
+	output := &github.CheckRunOutput{
+		Title:   github.String(description),
+		Summary: github.String(fmt.Sprintf("[Logs](%s)", url)),
+	}
+	if conclusion != "" {
+		status = "completed"
+		completedAt = &github.Timestamp{Time: *job.FinishedAt}
+		output = s.checkRunOutput(job, conclusion, description)
+	}
+
+	if job.CheckRunID == 0 {
+		opts := github.CreateCheckRunOptions{
+			Name:        job.Name,
+			HeadSHA:     job.SHA,
+			DetailsURL:  &url,
+			ExternalID:  github.String(job.ID),
+			Status:      github.String(status),
+			StartedAt:   startedAt,
+			CompletedAt: completedAt,
+			Output:      output,
+		}
+		if conclusion != "" {
+			opts.Conclusion = github.String(conclusion)
+		}
+		run, _, err := gh.Checks.CreateCheckRun(ctx, owner, repo, opts)
+		if err != nil {
+			return err
+		}
+		job.CheckRunID = run.GetID()
+		s.updateJob(job)
+		return nil
+	}
+
+	opts := &updateCheckRunOptions{
+		UpdateCheckRunOptions: github.UpdateCheckRunOptions{
+			Name:        job.Name,
+			DetailsURL:  &url,
+			ExternalID:  github.String(job.ID),
+			Status:      github.String(status),
+			CompletedAt: completedAt,
+			Output:      output,
+		},
+		StartedAt: startedAt,
+	}
+	if conclusion != "" {
+		opts.Conclusion = github.String(conclusion)
+	}
+	err := updateCheckRun(ctx, gh, owner, repo, job.CheckRunID, opts)
+	if err != nil && len(output.Annotations) != 0 {
+		// Annotations can make the whole update fail, for example if a matcher
+		// picked up a path that's not in the repo. Retry without them.
+		log.Printf("failed to update check run with annotations, retrying without them: %v", err)
+		output.Annotations = nil
+		err = updateCheckRun(ctx, gh, owner, repo, job.CheckRunID, opts)
+	}
+	return err
+}
+
+func updateCheckRun(ctx context.Context, gh *github.Client, owner string, repo string, id int64, opts *updateCheckRunOptions) error {
+	req, err := gh.NewRequest("PATCH", fmt.Sprintf("repos/%v/%v/check-runs/%v", owner, repo, id), opts)
+	if err != nil {
+		return err
+	}
+	_, err = gh.Do(ctx, req, nil)
+	return err
+}
+
+// checkRunOutput returns the output of a finished job's check run:
+// the tail of the log, and annotations for the diagnostics found in it.
+func (s *Service) checkRunOutput(job *Job, conclusion string, description string) *github.CheckRunOutput {
+	url := fmt.Sprintf("%s/jobs/%s", s.config.ExternalURL, job.ID)
+	logPath := filepath.Join(s.config.DataDir, "logs", job.ID)
+
+	title := description
+	if title == "" {
+		if conclusion == "success" {
+			title = "Succeeded"
+		} else if job.ExitCode != nil {
+			title = fmt.Sprintf("Failed with exit code %d", *job.ExitCode)
+		} else {
+			title = "Failed"
+		}
+	}
+
+	summary := fmt.Sprintf("[Full log](%s)\n", url)
+	if job.hasArtifacts() {
+		summary += fmt.Sprintf("\n[Artifacts](%s/artifacts/)\n", url)
+	}
+	if len(job.Sections) != 0 {
+		summary += "\n| Section | Duration |\n| --- | --- |\n"
+		for i, sec := range job.Sections {
+			if i == checkRunMaxSections {
+				break
+			}
+			name := sec.Name
+			if r := []rune(name); len(r) > checkRunMaxSectionName {
+				name = string(r[:checkRunMaxSectionName]) + "…"
+			}
+			name = markdownEscaper.Replace(name)
+			if sec.Failed {
+				name = "❌ " + name
+			}
+			summary += fmt.Sprintf("| [%s](%s#L%d) | %s |\n", name, url, sec.StartLine, formatElapsed(sec.Duration))
+		}
+		if more := len(job.Sections) - checkRunMaxSections + job.SectionsLeftOut; more > 0 {
+			summary += fmt.Sprintf("| … %d more | |\n", more)
+		}
+	}
+	tail, err := logTail(logPath)
+	if err != nil {
+		log.Printf("failed to read log tail: %v", err)
+	} else if tail != "" {
+		// The log can contain backticks, make sure the fence is longer than any run of them.
+		fence := "```"
+		for strings.Contains(tail, fence) {
+			fence += "`"
+		}
+		summary += fmt.Sprintf("\n%s\n%s\n%s\n", fence, tail, fence)
+	}
+
+	if len(summary) > checkRunSummaryMaxSize {
+		const note = "\n\n… (truncated)"
+		cut, _ := splitUTF8([]byte(summary[:checkRunSummaryMaxSize-len(note)]))
+		summary = string(cut) + note
+	}
+
+	output := &github.CheckRunOutput{
+		Title:   github.String(title),
+		Summary: github.String(summary),
+	}
+
+	problems, err := s.jobProblems(job)
+	if err != nil {
+		log.Printf("failed to match problems in log: %v", err)
+	}
+	output.Annotations = problemAnnotations(problems)
+
+	return output
+}
+
+// markdownEscaper escapes text in a markdown table cell, so it can't end the
+// cell or make links.
+var markdownEscaper = strings.NewReplacer(`\`, `\\`, "|", `\|`, "[", `\[`, "]", `\]`)
+
+// logTail returns the last lines of a log file.
+func logTail(path string) (string, error) {
+	f, err := openLog(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	var buf []byte
+	cut := false
+	if file, ok := f.(*os.File); ok {
+		stat, err := file.Stat()
+		if err != nil {
+			return "", err
+		}
+		offset := stat.Size() - logTailBytes
+		if offset < 0 {
+			offset = 0
+		}
+		buf = make([]byte, stat.Size()-offset)
+		_, err = file.ReadAt(buf, offset)
+		if err != nil && !errors.Is(err, io.EOF) {
+			return "", err
+		}
+		cut = offset > 0
+	} else {
+		// Compressed, it has to be read to the end.
+		chunk := make([]byte, 32*1024)
+		for {
+			n, err := f.Read(chunk)
+			buf = append(buf, chunk[:n]...)
+			if len(buf) > 2*logTailBytes {
+				buf = append(buf[:0], buf[len(buf)-logTailBytes:]...)
+				cut = true
+			}
+			if errors.Is(err, io.EOF) {
+				break
+			}
+			if err != nil {
+				return "", err
+			}
+		}
+		if len(buf) > logTailBytes {
+			buf = buf[len(buf)-logTailBytes:]
+			cut = true
+		}
+	}
+
+	tail := string(buf)
+	if cut {
+		// drop the first line, it's probably cut.
+		if _, rest, ok := strings.Cut(tail, "\n"); ok {
+			tail = rest
+		}
+	}
+	lines := strings.Split(strings.TrimRight(tail, "\n"), "\n")
+	if len(lines) > logTailLines {
+		lines = lines[len(lines)-logTailLines:]
+	}
+	return strings.Join(lines, "\n"), nil
+}
+
+// handleCheckRunRerequested re-runs the job of a check run when "Re-run" is
+// clicked in the GitHub UI.
+func (s *Service) handleCheckRunRerequested(ctx context.Context, gh *github.Client, e *github.CheckRunEvent) error {
+	jobID := e.CheckRun.GetExternalID()
+	if !validJobID(jobID) {
+		return errors.Errorf("invalid job ID '%s' in check run %d", jobID, e.CheckRun.GetID())
+	}
+
+	job, err := s.db.getJob(jobID)
+	if err != nil {
+		return err
+	}
+	if job == nil {
+		log.Printf("re-run requested for unknown job %s", jobID)
+		return nil
+	}
+	if *job.Repo.FullName != *e.Repo.FullName {
+		return errors.Errorf("job %s is not from repo %s", jobID, *e.Repo.FullName)
+	}
+
+	newJob := s.rerunJob(job)
+	log.Printf("re-running job %s as %s, requested by %s", job.ID, newJob.ID, e.GetSender().GetLogin())
+	s.enqueueJob(ctx, gh, newJob)
+	return nil
+}
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestCheckRunOutputSections(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.Mkdir(filepath.Join(dir, "logs"), 0700); err != nil {
+		t.Fatal(err)
+	}
+	// A log with lines longer than the summary can take.
+	long := strings.Repeat(strings.Repeat("x", 2000)+"\n", 50)
+	if err := os.WriteFile(filepath.Join(dir, "logs", "abc"), []byte(long), 0600); err != nil {
+		t.Fatal(err)
+	}
+	s := &Service{config: Config{DataDir: dir, ExternalURL: "https://bender.example.com"}}
+
+	job := &Job{ID: "abc"}
+	for i := 0; i < 5000; i++ {
+		job.Sections = append(job.Sections, LogSection{Name: "[a](javascript:x)|b" + strings.Repeat("y", 200), StartLine: i + 1})
+	}
+	summary := *s.checkRunOutput(job, "failure", "").Summary
+
+	if len(summary) > checkRunSummaryMaxSize {
+		t.Errorf("summary is %d bytes, more than the limit", len(summary))
+	}
+	if !strings.Contains(summary, `| [\[a\](javascript:x)\|b`) {
+		t.Errorf("section names not escaped:\n%s", summary[:500])
+	}
+	if n := strings.Count(summary, "#L"); n != checkRunMaxSections {
+		t.Errorf("got %d sections, want %d", n, checkRunMaxSections)
+	}
+	if !strings.Contains(summary, "| … 4950 more | |") {
+		t.Errorf("no count of the sections left out")
+	}
+}
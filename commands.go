@@ -0,0 +1,261 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/google/go-github/v52/github"
+	"github.com/sqlbunny/errors"
+)
+
+func (s *Service) handleCommands(ctx context.Context, gh *github.Client, outEvents *[]*Event, e *github.IssueCommentEvent) error {
+	errors := ""
+	commands := 0
+
+	for _, line := range strings.Split(*e.Comment.Body, "\n") {
+		command, ok := strings.CutPrefix(strings.TrimSpace(line), "bender ")
+		if !ok {
+			continue
+		}
+		commands++
+
+		err := s.handleCommand(ctx, gh, outEvents, e, command)
+		if err != nil {
+			log.Printf("Failed to handle command `%s`: %v", command, err)
+			errors += fmt.Sprintf("`%s`: %v\n", command, err)
+		}
+	}
+
+	if commands == 0 {
+		return nil
+	}
+
+	// React to the comment, so the user knows we saw it.
+	reaction := "+1"
+	if errors != "" {
+		reaction = "confused"
+	}
+	_, _, err := gh.Reactions.CreateIssueCommentReaction(ctx, *e.Repo.Owner.Login, *e.Repo.Name, *e.Comment.ID, reaction)
+	if err != nil {
+		log.Printf("Failed to react to comment: %v", err)
+	}
+
+	if errors != "" {
+		_, _, err := gh.Issues.CreateComment(ctx, *e.Repo.Owner.Login, *e.Repo.Name, *e.Issue.Number, &github.IssueComment{
+			Body: github.String(errors),
+		})
+		if err != nil {
+			log.Printf("Failed to post comment with command errors: %v", err)
+		}
+	}
+
+	return nil
+}
+
+func (s *Service) handleCommand(ctx context.Context, gh *github.Client, outEvents *[]*Event, e *github.IssueCommentEvent, command string) error {
+	dir, err := parseDirective(command)
+	if err != nil {
+		return err
+	}
+
+	if len(dir.Args) == 0 {
+		return errors.New("no command?")
+	}
+
+	switch dir.Args[0] {
+	case "run":
+		if len(dir.Args) > 2 {
+			return errors.Errorf("'run' takes at most one job name")
+		}
+		if len(dir.Args) == 1 && len(dir.Conditions) != 0 {
+			return errors.Errorf("'run' takes key=value arguments only with a job name")
+		}
+
+		if err := s.checkCommandPermission(ctx, gh, e); err != nil {
+			return err
+		}
+		pr, err := s.commandPR(ctx, gh, e)
+		if err != nil {
+			return err
+		}
+		event := s.pullRequestEvent(e.Repo, pr, *e.Installation.ID)
+		event.ApprovedBy = *e.Comment.User.Login
+
+		if len(dir.Args) == 1 {
+			*outEvents = append(*outEvents, event)
+			return nil
+		}
+
+		for _, c := range dir.Conditions {
+			if c.Op != "=" {
+				return errors.Errorf("'run' only takes key=value arguments")
+			}
+			event.Attributes[c.Key] = c.Value
+		}
+		_, err = s.handleEvent(ctx, gh, event, dir.Args[1])
+		return err
+	case "cancel":
+		if len(dir.Args) != 1 || len(dir.Conditions) != 0 {
+			return errors.Errorf("'cancel' takes no arguments")
+		}
+
+		if err := s.checkCommandPermission(ctx, gh, e); err != nil {
+			return err
+		}
+		if e.Issue.PullRequestLinks == nil {
+			return errors.Errorf("This is not a pull request!")
+		}
+
+		repo := *e.Repo.FullName
+		number := *e.Issue.Number
+		count := s.cancelJobs(func(j *Job) bool {
+			return *j.Repo.FullName == repo && j.PullRequest != nil && *j.PullRequest.Number == number
+		}, fmt.Sprintf("cancelled by @%s", *e.Comment.User.Login))
+		if count == 0 {
+			return errors.Errorf("no queued or running jobs to cancel")
+		}
+		return nil
+	case "retry":
+		if len(dir.Args) != 1 || len(dir.Conditions) != 0 {
+			return errors.Errorf("'retry' takes no arguments")
+		}
+
+		if err := s.checkCommandPermission(ctx, gh, e); err != nil {
+			return err
+		}
+		pr, err := s.commandPR(ctx, gh, e)
+		if err != nil {
+			return err
+		}
+
+		// Newest first, so the first run of each job is its latest one. The
+		// PR's jobs can't be older than it, give or take bender's clock.
+		var since time.Time
+		if pr.CreatedAt != nil {
+			since = pr.CreatedAt.Add(-time.Hour)
+		}
+		jobs, err := s.db.listRepoJobs(*e.Repo.FullName, since, func(j *Job) bool {
+			return j.SHA == *pr.Head.SHA && j.PullRequest != nil
+		}, 0)
+		if err != nil {
+			return err
+		}
+		latest := map[string]bool{}
+		retried := 0
+		for _, job := range jobs {
+			if latest[job.Name] {
+				continue
+			}
+			latest[job.Name] = true
+			if job.State != JobFailure {
+				continue
+			}
+
+			newJob := s.rerunJob(job)
+			log.Printf("retrying job %s as %s", job.ID, newJob.ID)
+			s.enqueueJob(ctx, gh, newJob)
+			retried++
+		}
+		if retried == 0 {
+			return errors.Errorf("no failed jobs for %s", *pr.Head.SHA)
+		}
+		return nil
+	case "trust":
+		if len(dir.Args) != 2 || len(dir.Conditions) != 0 {
+			return errors.Errorf("'trust' takes the SHA of the commit to trust")
+		}
+		sha := dir.Args[1]
+
+		if err := s.checkCommandPermission(ctx, gh, e); err != nil {
+			return err
+		}
+		pr, err := s.commandPR(ctx, gh, e)
+		if err != nil {
+			return err
+		}
+
+		err = s.approveTrust(*e.Repo.FullName, pr, sha, *e.Comment.User.Login)
+		if err != nil {
+			return err
+		}
+		event := s.pullRequestEvent(e.Repo, pr, *e.Installation.ID)
+		event.ApprovedBy = *e.Comment.User.Login
+		*outEvents = append(*outEvents, event)
+		return nil
+	case "approve":
+		if len(dir.Args) != 2 || len(dir.Conditions) != 0 {
+			return errors.Errorf("'approve' takes the SHA of the commit to approve")
+		}
+		sha := dir.Args[1]
+
+		if err := s.checkCommandPermission(ctx, gh, e); err != nil {
+			return err
+		}
+		pr, err := s.commandPR(ctx, gh, e)
+		if err != nil {
+			return err
+		}
+		if err := checkHeadSHA(pr, sha); err != nil {
+			return err
+		}
+
+		// Queued in the same transaction that finds them, so concurrent
+		// approvals can't both run them.
+		repo := *e.Repo.FullName
+		user := *e.Comment.User.Login
+		jobs, err := s.db.updateUnfinishedJobs(JobAwaitingApproval, func(j *Job) bool {
+			return *j.Repo.FullName == repo && j.SHA == *pr.Head.SHA && j.PullRequest != nil
+		}, func(j *Job) {
+			j.State = JobQueued
+			j.ApprovedBy = user
+		})
+		if err != nil {
+			return err
+		}
+		if len(jobs) == 0 {
+			return errors.Errorf("no jobs awaiting approval for %s", *pr.Head.SHA)
+		}
+		for _, job := range jobs {
+			log.Printf("job %s approved by @%s", job.ID, user)
+			s.enqueueJob(ctx, gh, job)
+		}
+		return nil
+	default:
+		return errors.Errorf("unknown command '%s'", dir.Args[0])
+	}
+}
+
+// checkCommandPermission checks the author of a command comment can write to the repo.
+func (s *Service) checkCommandPermission(ctx context.Context, gh *github.Client, e *github.IssueCommentEvent) error {
+	canWrite, err := s.hasWriteAccess(ctx, gh, e.Repo, *e.Comment.User.Login)
+	if err != nil {
+		return err
+	}
+	if !canWrite {
+		return errors.Errorf("permission denied")
+	}
+	return nil
+}
+
+func (s *Service) hasWriteAccess(ctx context.Context, gh *github.Client, repo *github.Repository, user string) (bool, error) {
+	perms, _, err := gh.Repositories.GetPermissionLevel(ctx, *repo.Owner.Login, *repo.Name, user)
+	if err != nil {
+		return false, err
+	}
+	return *perms.Permission == "admin" || *perms.Permission == "write", nil
+}
+
+// commandPR returns the PR a command comment was posted on.
+func (s *Service) commandPR(ctx context.Context, gh *github.Client, e *github.IssueCommentEvent) (*github.PullRequest, error) {
+	if e.Issue.PullRequestLinks == nil {
+		return nil, errors.Errorf("This is not a pull request!")
+	}
+	pr, _, err := gh.PullRequests.Get(ctx, *e.Repo.Owner.Login, *e.Repo.Name, *e.Issue.Number)
+	if err != nil {
+		return nil, err
+	}
+	return pr, nil
+}
@@ -0,0 +1,204 @@
+package main
+
+import (
+	"fmt"
+	"html/template"
+	"log"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+)
+
+// How many finished jobs the dashboard shows.
+const dashboardRecentJobs = 50
+
+var dashboardTemplate = template.Must(template.New("dashboard").Parse(`
+{{define "jobs"}}
+<table>
+	<tr><th>State</th>{{if not .Repo}}<th>Repo</th>{{end}}<th>Job</th><th>Ref</th><th>Commit</th><th>Started</th><th>Duration</th><th></th></tr>
+	{{range .Jobs}}
+	<tr class="{{.State}}">
+		<td>{{.State}}{{if .QueuePosition}} #{{.QueuePosition}}{{end}}</td>
+		{{if not $.Repo}}<td><a href="/repos/{{.Repo}}">{{.Repo}}</a></td>{{end}}
+		<td><a href="/jobs/{{.ID}}">{{.Name}}</a></td>
+		<td>{{if .PR}}<a href="{{.RepoURL}}/pull/{{.PR}}">PR #{{.PR}}</a>{{else}}{{.Branch}}{{end}}</td>
+		<td><a href="{{.RepoURL}}/commit/{{.SHA}}"><code>{{printf "%.8s" .SHA}}</code></a></td>
+		<td>{{.Started}}</td>
+		<td>{{.Duration}}</td>
+		<td>{{if .HasArtifacts}}<a href="/jobs/{{.ID}}/artifacts/">artifacts</a>{{end}}</td>
+	</tr>
+	{{else}}
+	<tr><td colspan="8">No jobs.</td></tr>
+	{{end}}
+</table>
+{{end}}
+
+{{define "content"}}
+<h2>Running and queued</h2>
+{{template "jobs" .Active}}
+<h2>Recent</h2>
+{{template "jobs" .Recent}}
+{{end}}
+
+{{define "page"}}<!DOCTYPE html>
+<html>
+	<head>
+		<title>{{if .Repo}}{{.Repo}} - {{end}}bender</title>
+		<noscript><meta http-equiv="refresh" content="10"></noscript>
+		<style type="text/css">
+			body { font-family: sans-serif; }
+			table { border-collapse: collapse; }
+			td, th { padding: 2px 8px; text-align: left; }
+			.running td:first-child { color: #b08800; }
+			.queued td:first-child, .awaiting_approval td:first-child { color: #666; }
+			.success td:first-child { color: #22863a; }
+			.failure td:first-child { color: #cb2431; }
+			.cancelled td:first-child { color: #666; }
+		</style>
+	</head>
+	<body>
+		<h1><a href="/">bender</a>{{if .Repo}} / {{.Repo}}{{end}}</h1>
+		<a href="/artifacts">Artifacts usage</a>
+		<form action="/search">
+			<input name="q" placeholder="Search logs" size="40">
+			{{if .Repo}}<input type="hidden" name="repo" value="{{.Repo}}">{{end}}
+		</form>
+		<div id="content">{{template "content" .}}</div>
+		<script>
+			// Reload the job lists every few seconds.
+			setInterval(async () => {
+				const url = new URL(location.href)
+				url.searchParams.set("partial", "1")
+				const res = await fetch(url)
+				if (res.ok) {
+					document.getElementById("content").innerHTML = await res.text()
+				}
+			}, 5000)
+		</script>
+	</body>
+</html>
+{{end}}
+`))
+
+type dashboardJob struct {
+	ID            string
+	Name          string
+	Repo          string
+	RepoURL       string
+	Branch        string
+	PR            int
+	SHA           string
+	State         JobState
+	QueuePosition int
+	Started       string
+	Duration      string
+	HasArtifacts  bool
+}
+
+type dashboardJobs struct {
+	// Empty on the index page, where jobs from all repos are shown.
+	Repo string
+	Jobs []dashboardJob
+}
+
+func (s *Service) dashboardJob(job *Job) dashboardJob {
+	res := dashboardJob{
+		ID:      job.ID,
+		Name:    job.Name,
+		Repo:    *job.Repo.FullName,
+		RepoURL: job.Repo.GetHTMLURL(),
+		Branch:  job.Attributes["branch"],
+		SHA:     job.SHA,
+		State:   job.State,
+	}
+	if job.PullRequest != nil {
+		res.PR = *job.PullRequest.Number
+	}
+	if job.State == JobQueued {
+		res.QueuePosition = s.queuePosition(job.ID)
+	}
+	if job.StartedAt != nil {
+		res.Started = job.StartedAt.Local().Format("2006-01-02 15:04:05")
+		end := time.Now()
+		if job.FinishedAt != nil {
+			end = *job.FinishedAt
+		}
+		res.Duration = end.Sub(*job.StartedAt).Round(time.Second).String()
+	}
+	res.HasArtifacts = job.hasArtifacts()
+	return res
+}
+
+func (s *Service) HandleDashboard(w http.ResponseWriter, r *http.Request) {
+	repo := ""
+	if owner := chi.URLParam(r, "owner"); owner != "" {
+		repo = fmt.Sprintf("%s/%s", owner, chi.URLParam(r, "repo"))
+	}
+	inRepo := func(j *Job) bool {
+		return repo == "" || *j.Repo.FullName == repo
+	}
+
+	active, err := s.db.listUnfinishedJobs(inRepo)
+	if err != nil {
+		log.Printf("failed to list jobs: %v", err)
+		http.Error(w, http.StatusText(500), 500)
+		return
+	}
+	finished := func(j *Job) bool {
+		return j.State.finished()
+	}
+	var recent []*Job
+	if repo != "" {
+		recent, err = s.db.listRepoJobs(repo, time.Time{}, finished, dashboardRecentJobs)
+	} else {
+		recent, err = s.db.listJobs(finished, dashboardRecentJobs)
+	}
+	if err != nil {
+		log.Printf("failed to list jobs: %v", err)
+		http.Error(w, http.StatusText(500), 500)
+		return
+	}
+
+	data := struct {
+		Repo   string
+		Active dashboardJobs
+		Recent dashboardJobs
+	}{
+		Repo:   repo,
+		Active: dashboardJobs{Repo: repo},
+		Recent: dashboardJobs{Repo: repo},
+	}
+	for _, job := range active {
+		data.Active.Jobs = append(data.Active.Jobs, s.dashboardJob(job))
+	}
+	for _, job := range recent {
+		data.Recent.Jobs = append(data.Recent.Jobs, s.dashboardJob(job))
+	}
+
+	// Running first, then queued in the order they'll run, then awaiting approval.
+	rank := func(j dashboardJob) int {
+		switch j.State {
+		case JobRunning:
+			return 0
+		case JobQueued:
+			return 1 + j.QueuePosition
+		default:
+			return 1 << 30
+		}
+	}
+	sort.SliceStable(data.Active.Jobs, func(i, j int) bool {
+		return rank(data.Active.Jobs[i]) < rank(data.Active.Jobs[j])
+	})
+
+	w.Header().Add("Content-Type", "text/html; charset=utf-8")
+	name := "page"
+	if r.URL.Query().Get("partial") != "" {
+		name = "content"
+	}
+	err = dashboardTemplate.ExecuteTemplate(w, name, data)
+	if err != nil {
+		log.Printf("failed to render dashboard: %v", err)
+	}
+}
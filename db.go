@@ -0,0 +1,688 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/sqlbunny/errors"
+	bolt "go.etcd.io/bbolt"
+)
+
+type JobState string
+
+const (
+	JobQueued    JobState = "queued"
+	JobRunning   JobState = "running"
+	JobSuccess   JobState = "success"
+	JobFailure   JobState = "failure"
+	JobCancelled JobState = "cancelled"
+	// Jobs of new contributors' PRs wait in this state until approved with `bender approve`.
+	JobAwaitingApproval JobState = "awaiting_approval"
+)
+
+func (st JobState) finished() bool {
+	return st == JobSuccess || st == JobFailure || st == JobCancelled
+}
+
+var (
+	// job ID -> JSON-encoded Job
+	bucketJobs = []byte("jobs")
+	// creation time (8 bytes, big endian unix nanos) + job ID -> empty.
+	// Used to list jobs newest-first without decoding all of them.
+	bucketJobsByTime = []byte("jobs_by_time")
+	// "owner/repo" + "\x00" + creation time + job ID -> empty.
+	// Used to list a repo's jobs newest-first without decoding the other repos' jobs.
+	bucketJobsByRepo = []byte("jobs_by_repo")
+	// job ID -> state, for jobs that aren't finished.
+	// Used to find queued, running and awaiting approval jobs without decoding all of them.
+	bucketUnfinishedJobs = []byte("unfinished_jobs")
+	// finish time (8 bytes, big endian unix nanos) + job ID -> JSON-encoded
+	// retainedJob, for finished jobs whose log and artifacts aren't deleted.
+	// Used by applyRetention, so it doesn't decode all finished jobs.
+	bucketRetainedJobs = []byte("retained_jobs")
+	// job ID -> JSON-encoded jobArtifacts, for jobs with artifacts.
+	bucketJobArtifacts = []byte("job_artifacts")
+	// "owner/repo" -> JSON-encoded artifactsUsage, kept up to date from job_artifacts.
+	bucketArtifactsUsage = []byte("artifacts_usage")
+	// "owner/repo#number" -> JSON-encoded []TrustApproval, oldest first.
+	bucketTrustApprovals = []byte("trust_approvals")
+	// token + "\x00" + job ID -> empty, for the tokens in the job's log. See search.go.
+	bucketLogIndex = []byte("log_index")
+	// job ID -> the job's tokens in log_index, "\n"-separated. Jobs whose log is indexed.
+	bucketLogIndexJobs = []byte("log_index_jobs")
+	// job ID -> empty, for finished jobs whose log isn't indexed yet.
+	bucketLogIndexPending = []byte("log_index_pending")
+)
+
+type DB struct {
+	db *bolt.DB
+}
+
+func openDB(path string) (*DB, error) {
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: 5 * time.Second})
+	if err != nil {
+		return nil, errors.Errorf("failed to open db %s: %w", path, err)
+	}
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		// Indexes created after jobs were are filled in with the existing jobs.
+		fill, fillArtifacts := false, false
+		if tx.Bucket(bucketJobs) != nil {
+			fillArtifacts = tx.Bucket(bucketJobArtifacts) == nil
+			fill = fillArtifacts || tx.Bucket(bucketJobsByRepo) == nil || tx.Bucket(bucketUnfinishedJobs) == nil ||
+				tx.Bucket(bucketRetainedJobs) == nil || tx.Bucket(bucketLogIndexPending) == nil
+		}
+		for _, b := range [][]byte{bucketJobs, bucketJobsByTime, bucketJobsByRepo, bucketUnfinishedJobs, bucketRetainedJobs, bucketJobArtifacts, bucketArtifactsUsage, bucketTrustApprovals, bucketLogIndex, bucketLogIndexJobs, bucketLogIndexPending} {
+			if _, err := tx.CreateBucketIfNotExists(b); err != nil {
+				return err
+			}
+		}
+		if fill {
+			return tx.Bucket(bucketJobs).ForEach(func(k, v []byte) error {
+				job := &Job{}
+				if err := json.Unmarshal(v, job); err != nil {
+					return errors.Errorf("failed to decode job %s: %w", k, err)
+				}
+				if err := indexJob(tx, job); err != nil {
+					return err
+				}
+				if fillArtifacts && job.State.finished() && job.ArtifactsSize == 0 && job.ArtifactsExpiredAt == nil && job.DeletedAt == nil {
+					// Jobs from before artifact sizes were recorded, expireArtifacts
+					// checks them once.
+					data, err := json.Marshal(jobArtifacts{Repo: job.Repo.GetFullName(), FinishedAt: job.FinishedAt})
+					if err != nil {
+						return err
+					}
+					return tx.Bucket(bucketJobArtifacts).Put(k, data)
+				}
+				return nil
+			})
+		}
+		return nil
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	return &DB{db: db}, nil
+}
+
+func jobTimeKey(job *Job) []byte {
+	key := make([]byte, 8, 8+len(job.ID))
+	binary.BigEndian.PutUint64(key, uint64(job.CreatedAt.UnixNano()))
+	return append(key, job.ID...)
+}
+
+func jobRepoKey(job *Job) []byte {
+	return append([]byte(job.Repo.GetFullName()+"\x00"), jobTimeKey(job)...)
+}
+
+// saveJob inserts or updates a job. CreatedAt must not change after the
+// first save, and FinishedAt once it's finished, since they're part of index
+// keys.
+func (d *DB) saveJob(job *Job) error {
+	data, err := json.Marshal(job)
+	if err != nil {
+		return err
+	}
+
+	return d.db.Update(func(tx *bolt.Tx) error {
+		return putJob(tx, job, data)
+	})
+}
+
+func putJob(tx *bolt.Tx, job *Job, data []byte) error {
+	err := tx.Bucket(bucketJobs).Put([]byte(job.ID), data)
+	if err != nil {
+		return err
+	}
+	err = tx.Bucket(bucketJobsByTime).Put(jobTimeKey(job), nil)
+	if err != nil {
+		return err
+	}
+	return indexJob(tx, job)
+}
+
+// indexJob updates the indexes of a job.
+func indexJob(tx *bolt.Tx, job *Job) error {
+	if err := tx.Bucket(bucketJobsByRepo).Put(jobRepoKey(job), nil); err != nil {
+		return err
+	}
+	if err := indexJobArtifacts(tx, job); err != nil {
+		return err
+	}
+	if !job.State.finished() {
+		return tx.Bucket(bucketUnfinishedJobs).Put([]byte(job.ID), []byte(job.State))
+	}
+	if err := tx.Bucket(bucketUnfinishedJobs).Delete([]byte(job.ID)); err != nil {
+		return err
+	}
+
+	pending := tx.Bucket(bucketLogIndexPending)
+	if job.DeletedAt != nil {
+		if err := pending.Delete([]byte(job.ID)); err != nil {
+			return err
+		}
+	} else if tx.Bucket(bucketLogIndexJobs).Get([]byte(job.ID)) == nil {
+		if err := pending.Put([]byte(job.ID), nil); err != nil {
+			return err
+		}
+	}
+
+	b := tx.Bucket(bucketRetainedJobs)
+	finishedAt := job.CreatedAt
+	if job.FinishedAt != nil {
+		finishedAt = *job.FinishedAt
+	}
+	key := retainedJobKey(finishedAt, job.ID)
+	if job.DeletedAt != nil {
+		return b.Delete(key)
+	}
+	if b.Get(key) != nil {
+		// Keep what applyRetention already did to it.
+		return nil
+	}
+	data, err := json.Marshal(retainedJob{Repo: job.Repo.GetFullName(), State: job.State})
+	if err != nil {
+		return err
+	}
+	return b.Put(key, data)
+}
+
+func retainedJobKey(finishedAt time.Time, id string) []byte {
+	key := make([]byte, 8, 8+len(id))
+	binary.BigEndian.PutUint64(key, uint64(finishedAt.UnixNano()))
+	return append(key, id...)
+}
+
+// indexJobArtifacts updates job_artifacts for a job, and the usage of its repo
+// in artifacts_usage.
+func indexJobArtifacts(tx *bolt.Tx, job *Job) error {
+	b := tx.Bucket(bucketJobArtifacts)
+	old := jobArtifacts{}
+	if v := b.Get([]byte(job.ID)); v != nil {
+		if err := json.Unmarshal(v, &old); err != nil {
+			return errors.Errorf("failed to decode artifacts of job %s: %w", job.ID, err)
+		}
+		if old.Size == 0 && job.ArtifactsSize == 0 && job.ArtifactsExpiredAt == nil && job.DeletedAt == nil {
+			// Not checked yet, see openDB.
+			return nil
+		}
+	}
+
+	var size int64
+	if job.hasArtifacts() {
+		size = job.ArtifactsSize
+		data, err := json.Marshal(jobArtifacts{Repo: job.Repo.GetFullName(), Size: size, FinishedAt: job.FinishedAt})
+		if err != nil {
+			return err
+		}
+		if err := b.Put([]byte(job.ID), data); err != nil {
+			return err
+		}
+	} else if err := b.Delete([]byte(job.ID)); err != nil {
+		return err
+	}
+	if size == old.Size {
+		return nil
+	}
+
+	repo := job.Repo.GetFullName()
+	usage := tx.Bucket(bucketArtifactsUsage)
+	u := artifactsUsage{Repo: repo}
+	if v := usage.Get([]byte(repo)); v != nil {
+		if err := json.Unmarshal(v, &u); err != nil {
+			return errors.Errorf("failed to decode artifacts usage of %s: %w", repo, err)
+		}
+	}
+	u.Size += size - old.Size
+	if old.Size == 0 {
+		u.Jobs++
+	} else if size == 0 {
+		u.Jobs--
+	}
+	if u.Jobs <= 0 {
+		return usage.Delete([]byte(repo))
+	}
+	data, err := json.Marshal(u)
+	if err != nil {
+		return err
+	}
+	return usage.Put([]byte(repo), data)
+}
+
+// listJobArtifacts returns the jobs with artifacts.
+func (d *DB) listJobArtifacts() ([]jobArtifacts, error) {
+	var res []jobArtifacts
+	err := d.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(bucketJobArtifacts).ForEach(func(k, v []byte) error {
+			a := jobArtifacts{}
+			if err := json.Unmarshal(v, &a); err != nil {
+				return errors.Errorf("failed to decode artifacts of job %s: %w", k, err)
+			}
+			a.ID = string(k)
+			res = append(res, a)
+			return nil
+		})
+	})
+	return res, err
+}
+
+// uncheckJobArtifacts removes a job from job_artifacts that openDB added to
+// have its artifacts checked, once they're checked and there are none.
+func (d *DB) uncheckJobArtifacts(id string) error {
+	return d.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(bucketJobArtifacts).Delete([]byte(id))
+	})
+}
+
+// getArtifactsUsage returns the artifacts usage of a repo.
+func (d *DB) getArtifactsUsage(repo string) (artifactsUsage, error) {
+	u := artifactsUsage{Repo: repo}
+	err := d.db.View(func(tx *bolt.Tx) error {
+		v := tx.Bucket(bucketArtifactsUsage).Get([]byte(repo))
+		if v == nil {
+			return nil
+		}
+		return json.Unmarshal(v, &u)
+	})
+	return u, err
+}
+
+// listArtifactsUsage returns the artifacts usage of the repos with artifacts.
+func (d *DB) listArtifactsUsage() ([]artifactsUsage, error) {
+	var res []artifactsUsage
+	err := d.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(bucketArtifactsUsage).ForEach(func(k, v []byte) error {
+			u := artifactsUsage{}
+			if err := json.Unmarshal(v, &u); err != nil {
+				return errors.Errorf("failed to decode artifacts usage of %s: %w", k, err)
+			}
+			res = append(res, u)
+			return nil
+		})
+	})
+	return res, err
+}
+
+// listRetainedJobs returns the finished jobs whose log and artifacts aren't
+// deleted, oldest first.
+func (d *DB) listRetainedJobs() ([]retainedJob, error) {
+	var jobs []retainedJob
+	err := d.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(bucketRetainedJobs).ForEach(func(k, v []byte) error {
+			r := retainedJob{}
+			if err := json.Unmarshal(v, &r); err != nil {
+				return errors.Errorf("failed to decode retained job %s: %w", k[8:], err)
+			}
+			r.ID = string(k[8:])
+			r.FinishedAt = time.Unix(0, int64(binary.BigEndian.Uint64(k[:8])))
+			jobs = append(jobs, r)
+			return nil
+		})
+	})
+	return jobs, err
+}
+
+// setLogCompressed records that a retained job's log is compressed. It does
+// nothing if the job's data was deleted meanwhile.
+func (d *DB) setLogCompressed(r retainedJob) error {
+	return d.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(bucketRetainedJobs)
+		key := retainedJobKey(r.FinishedAt, r.ID)
+		if b.Get(key) == nil {
+			return nil
+		}
+		r.LogCompressed = true
+		data, err := json.Marshal(r)
+		if err != nil {
+			return err
+		}
+		return b.Put(key, data)
+	})
+}
+
+// getJob returns the job with the given ID, or nil if it doesn't exist.
+func (d *DB) getJob(id string) (*Job, error) {
+	var job *Job
+	err := d.db.View(func(tx *bolt.Tx) error {
+		data := tx.Bucket(bucketJobs).Get([]byte(id))
+		if data == nil {
+			return nil
+		}
+		job = &Job{}
+		return json.Unmarshal(data, job)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return job, nil
+}
+
+// listJobs returns up to `limit` jobs for which `filter` returns true,
+// newest first. If filter is nil, all jobs match. If limit is 0, there's no limit.
+func (d *DB) listJobs(filter func(*Job) bool, limit int) ([]*Job, error) {
+	var res []*Job
+	err := d.db.View(func(tx *bolt.Tx) error {
+		jobs := tx.Bucket(bucketJobs)
+		c := tx.Bucket(bucketJobsByTime).Cursor()
+		for k, _ := c.Last(); k != nil; k, _ = c.Prev() {
+			data := jobs.Get(k[8:])
+			if data == nil {
+				continue
+			}
+
+			job := &Job{}
+			if err := json.Unmarshal(data, job); err != nil {
+				return errors.Errorf("failed to decode job %s: %w", k[8:], err)
+			}
+			if filter != nil && !filter(job) {
+				continue
+			}
+
+			res = append(res, job)
+			if limit != 0 && len(res) >= limit {
+				break
+			}
+		}
+		return nil
+	})
+	return res, err
+}
+
+// listUnfinishedJobs returns the jobs that aren't finished for which filter
+// returns true, newest first.
+func (d *DB) listUnfinishedJobs(filter func(*Job) bool) ([]*Job, error) {
+	var res []*Job
+	err := d.db.View(func(tx *bolt.Tx) error {
+		jobs := tx.Bucket(bucketJobs)
+		return tx.Bucket(bucketUnfinishedJobs).ForEach(func(k, v []byte) error {
+			data := jobs.Get(k)
+			if data == nil {
+				return nil
+			}
+			job := &Job{}
+			if err := json.Unmarshal(data, job); err != nil {
+				return errors.Errorf("failed to decode job %s: %w", k, err)
+			}
+			if filter(job) {
+				res = append(res, job)
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(res, func(i, j int) bool {
+		return res[i].CreatedAt.After(res[j].CreatedAt)
+	})
+	return res, nil
+}
+
+// updateUnfinishedJobs calls update on the unfinished jobs in the given state
+// for which filter returns true, and saves them, all in one transaction. It
+// returns the updated jobs, newest first. update must change their state, so
+// when it's called concurrently each job is only updated once.
+func (d *DB) updateUnfinishedJobs(state JobState, filter func(*Job) bool, update func(*Job)) ([]*Job, error) {
+	var res []*Job
+	err := d.db.Update(func(tx *bolt.Tx) error {
+		jobs := tx.Bucket(bucketJobs)
+		var ids [][]byte
+		err := tx.Bucket(bucketUnfinishedJobs).ForEach(func(k, v []byte) error {
+			if JobState(v) == state {
+				ids = append(ids, append([]byte(nil), k...))
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		for _, id := range ids {
+			data := jobs.Get(id)
+			if data == nil {
+				continue
+			}
+			job := &Job{}
+			if err := json.Unmarshal(data, job); err != nil {
+				return errors.Errorf("failed to decode job %s: %w", id, err)
+			}
+			if !filter(job) {
+				continue
+			}
+
+			update(job)
+			data, err := json.Marshal(job)
+			if err != nil {
+				return err
+			}
+			if err := putJob(tx, job, data); err != nil {
+				return err
+			}
+			res = append(res, job)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(res, func(i, j int) bool {
+		return res[i].CreatedAt.After(res[j].CreatedAt)
+	})
+	return res, nil
+}
+
+// listJobsSince is like listJobs, for the jobs created after since. If ids
+// isn't nil, only the jobs with an ID in it are decoded and passed to filter.
+func (d *DB) listJobsSince(since time.Time, ids map[string]bool, filter func(*Job) bool, limit int) ([]*Job, error) {
+	var res []*Job
+	err := d.db.View(func(tx *bolt.Tx) error {
+		jobs := tx.Bucket(bucketJobs)
+		c := tx.Bucket(bucketJobsByTime).Cursor()
+		for k, _ := c.Last(); k != nil; k, _ = c.Prev() {
+			if int64(binary.BigEndian.Uint64(k)) < since.UnixNano() {
+				break
+			}
+			if ids != nil && !ids[string(k[8:])] {
+				continue
+			}
+			data := jobs.Get(k[8:])
+			if data == nil {
+				continue
+			}
+
+			job := &Job{}
+			if err := json.Unmarshal(data, job); err != nil {
+				return errors.Errorf("failed to decode job %s: %w", k[8:], err)
+			}
+			if filter != nil && !filter(job) {
+				continue
+			}
+
+			res = append(res, job)
+			if limit != 0 && len(res) >= limit {
+				break
+			}
+		}
+		return nil
+	})
+	return res, err
+}
+
+// listRepoJobs is like listJobsSince, for the jobs of a repo. A zero since
+// lists all of them.
+func (d *DB) listRepoJobs(repo string, since time.Time, filter func(*Job) bool, limit int) ([]*Job, error) {
+	prefix := []byte(repo + "\x00")
+	var res []*Job
+	err := d.db.View(func(tx *bolt.Tx) error {
+		jobs := tx.Bucket(bucketJobs)
+		c := tx.Bucket(bucketJobsByRepo).Cursor()
+		// Start from the last key of the repo: before the first one after it.
+		k, _ := c.Seek([]byte(repo + "\x01"))
+		if k == nil {
+			k, _ = c.Last()
+		} else {
+			k, _ = c.Prev()
+		}
+		for ; k != nil && bytes.HasPrefix(k, prefix); k, _ = c.Prev() {
+			key := k[len(prefix):]
+			if !since.IsZero() && int64(binary.BigEndian.Uint64(key)) < since.UnixNano() {
+				break
+			}
+			data := jobs.Get(key[8:])
+			if data == nil {
+				continue
+			}
+
+			job := &Job{}
+			if err := json.Unmarshal(data, job); err != nil {
+				return errors.Errorf("failed to decode job %s: %w", key[8:], err)
+			}
+			if filter != nil && !filter(job) {
+				continue
+			}
+
+			res = append(res, job)
+			if limit != 0 && len(res) >= limit {
+				break
+			}
+		}
+		return nil
+	})
+	return res, err
+}
+
+func trustKey(repo string, number int) []byte {
+	return []byte(fmt.Sprintf("%s#%d", repo, number))
+}
+
+// updateTrustApprovals calls f with the approvals of a PR, and saves what it returns.
+func (d *DB) updateTrustApprovals(repo string, number int, f func([]TrustApproval) []TrustApproval) error {
+	return d.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(bucketTrustApprovals)
+		var approvals []TrustApproval
+		if data := b.Get(trustKey(repo, number)); data != nil {
+			if err := json.Unmarshal(data, &approvals); err != nil {
+				return err
+			}
+		}
+
+		data, err := json.Marshal(f(approvals))
+		if err != nil {
+			return err
+		}
+		return b.Put(trustKey(repo, number), data)
+	})
+}
+
+// getTrustApprovals returns all approvals of a PR, oldest first.
+func (d *DB) getTrustApprovals(repo string, number int) ([]TrustApproval, error) {
+	var approvals []TrustApproval
+	err := d.db.View(func(tx *bolt.Tx) error {
+		data := tx.Bucket(bucketTrustApprovals).Get(trustKey(repo, number))
+		if data == nil {
+			return nil
+		}
+		return json.Unmarshal(data, &approvals)
+	})
+	return approvals, err
+}
+
+// Tokens are added to the log index in transactions of this many, so big
+// logs don't block other writes for long.
+const logIndexBatchSize = 10000
+
+// indexJobLog adds a job's log tokens to the log index. The job is only marked
+// as indexed after all of them are added.
+func (d *DB) indexJobLog(jobID string, tokens []string) error {
+	for i := 0; i < len(tokens); i += logIndexBatchSize {
+		batch := tokens[i:]
+		if len(batch) > logIndexBatchSize {
+			batch = batch[:logIndexBatchSize]
+		}
+		err := d.db.Update(func(tx *bolt.Tx) error {
+			b := tx.Bucket(bucketLogIndex)
+			for _, t := range batch {
+				if err := b.Put([]byte(t+"\x00"+jobID), nil); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return d.db.Update(func(tx *bolt.Tx) error {
+		if err := tx.Bucket(bucketLogIndexPending).Delete([]byte(jobID)); err != nil {
+			return err
+		}
+		return tx.Bucket(bucketLogIndexJobs).Put([]byte(jobID), []byte(strings.Join(tokens, "\n")))
+	})
+}
+
+// unindexJobLog removes a job's log from the log index.
+func (d *DB) unindexJobLog(jobID string) error {
+	return d.db.Update(func(tx *bolt.Tx) error {
+		jobs := tx.Bucket(bucketLogIndexJobs)
+		data := jobs.Get([]byte(jobID))
+		if data == nil {
+			return nil
+		}
+		b := tx.Bucket(bucketLogIndex)
+		for _, t := range strings.Split(string(data), "\n") {
+			if err := b.Delete([]byte(t + "\x00" + jobID)); err != nil {
+				return err
+			}
+		}
+		return jobs.Delete([]byte(jobID))
+	})
+}
+
+// listPendingLogIndex returns the IDs of the finished jobs whose log isn't
+// indexed yet.
+func (d *DB) listPendingLogIndex() ([]string, error) {
+	var res []string
+	err := d.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(bucketLogIndexPending).ForEach(func(k, v []byte) error {
+			res = append(res, string(k))
+			return nil
+		})
+	})
+	return res, err
+}
+
+// searchLogIndex returns the IDs of the jobs whose logs have, for each of
+// the given prefixes, a token starting with it.
+func (d *DB) searchLogIndex(prefixes []string) (map[string]bool, error) {
+	var res map[string]bool
+	err := d.db.View(func(tx *bolt.Tx) error {
+		c := tx.Bucket(bucketLogIndex).Cursor()
+		for _, prefix := range prefixes {
+			found := map[string]bool{}
+			for k, _ := c.Seek([]byte(prefix)); k != nil && bytes.HasPrefix(k, []byte(prefix)); k, _ = c.Next() {
+				i := bytes.IndexByte(k, 0)
+				if i < 0 {
+					continue
+				}
+				id := string(k[i+1:])
+				if res == nil || res[id] {
+					found[id] = true
+				}
+			}
+			res = found
+			if len(res) == 0 {
+				break
+			}
+		}
+		return nil
+	})
+	return res, err
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/google/go-github/v52/github"
+)
+
+func TestUpdateUnfinishedJobs(t *testing.T) {
+	db, err := openDB(filepath.Join(t.TempDir(), "db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.db.Close()
+
+	now := time.Now()
+	for i, state := range []JobState{JobAwaitingApproval, JobAwaitingApproval, JobQueued, JobSuccess, JobAwaitingApproval} {
+		job := &Job{
+			Event:     &Event{Repo: &github.Repository{FullName: github.String("foo/bar")}, SHA: "abc"},
+			ID:        string(rune('a' + i)),
+			State:     state,
+			CreatedAt: now.Add(time.Duration(i) * time.Second),
+		}
+		if i == 4 {
+			job.SHA = "def"
+		}
+		if err := db.saveJob(job); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	approve := func() []*Job {
+		jobs, err := db.updateUnfinishedJobs(JobAwaitingApproval, func(j *Job) bool {
+			return j.SHA == "abc"
+		}, func(j *Job) {
+			j.State = JobQueued
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return jobs
+	}
+	jobs := approve()
+	if len(jobs) != 2 || jobs[0].ID != "b" || jobs[1].ID != "a" {
+		t.Fatalf("wrong approved jobs: %+v", jobs)
+	}
+	if job, err := db.getJob("a"); err != nil || job.State != JobQueued {
+		t.Fatalf("approved job not saved: %+v, %v", job, err)
+	}
+	if jobs := approve(); len(jobs) != 0 {
+		t.Fatalf("jobs approved twice: %+v", jobs)
+	}
+
+	// Finished jobs leave the index.
+	jobs, err = db.updateUnfinishedJobs(JobAwaitingApproval, func(j *Job) bool { return true }, func(j *Job) {
+		j.State = JobCancelled
+	})
+	if err != nil || len(jobs) != 1 || jobs[0].ID != "e" {
+		t.Fatalf("wrong cancelled jobs: %+v, %v", jobs, err)
+	}
+	jobs, err = db.updateUnfinishedJobs(JobCancelled, func(j *Job) bool { return true }, func(j *Job) {})
+	if err != nil || len(jobs) != 0 {
+		t.Fatalf("finished jobs in the index: %+v, %v", jobs, err)
+	}
+
+	jobs, err = db.listUnfinishedJobs(func(j *Job) bool { return true })
+	if err != nil || len(jobs) != 3 || jobs[0].ID != "c" || jobs[1].ID != "b" || jobs[2].ID != "a" {
+		t.Fatalf("wrong unfinished jobs: %+v, %v", jobs, err)
+	}
+}
+
+func TestListRepoJobs(t *testing.T) {
+	db, err := openDB(filepath.Join(t.TempDir(), "db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.db.Close()
+
+	now := time.Now()
+	// "foo/bar2" sorts right after "foo/bar", and "foo/ba" before it.
+	for i, repo := range []string{"foo/bar", "foo/bar2", "foo/bar", "foo/ba", "foo/bar"} {
+		job := &Job{
+			Event:     &Event{Repo: &github.Repository{FullName: github.String(repo)}},
+			ID:        string(rune('a' + i)),
+			State:     JobSuccess,
+			CreatedAt: now.Add(time.Duration(i-10) * time.Hour),
+		}
+		if err := db.saveJob(job); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	jobs, err := db.listRepoJobs("foo/bar", time.Time{}, nil, 0)
+	if err != nil || len(jobs) != 3 || jobs[0].ID != "e" || jobs[1].ID != "c" || jobs[2].ID != "a" {
+		t.Fatalf("wrong repo jobs: %+v, %v", jobs, err)
+	}
+	jobs, err = db.listRepoJobs("foo/bar", now.Add(-9*time.Hour), nil, 1)
+	if err != nil || len(jobs) != 1 || jobs[0].ID != "e" {
+		t.Fatalf("wrong recent repo jobs: %+v, %v", jobs, err)
+	}
+	jobs, err = db.listRepoJobs("foo/bar2", now.Add(-7*time.Hour), nil, 0)
+	if err != nil || len(jobs) != 0 {
+		t.Fatalf("jobs before since listed: %+v, %v", jobs, err)
+	}
+}
@@ -11,6 +11,7 @@ require (
 	github.com/opencontainers/image-spec v1.0.1
 	github.com/opencontainers/runtime-spec v1.0.3-0.20200929063507-e6143ca7d51d
 	github.com/sqlbunny/errors v0.0.0-20191008151415-dd4d77e0bd8d
+	go.etcd.io/bbolt v1.3.5
 	golang.org/x/sys v0.7.0
 	gopkg.in/yaml.v3 v3.0.1
 )
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"regexp"
+	"strings"
+
+	"github.com/containerd/containerd"
+	"github.com/containerd/containerd/content"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// imageMatches checks if an image ref matches a pattern from `allowed_images`.
+// `*` matches any sequence of characters, including `/` and `:`.
+// For example `embassy.dev/*` matches `embassy.dev/ci:latest`.
+func imageMatches(ref string, pattern string) bool {
+	re := "^" + strings.ReplaceAll(regexp.QuoteMeta(pattern), `\*`, ".*") + "$"
+	ok, err := regexp.MatchString(re, ref)
+	return err == nil && ok
+}
+
+func (s *Service) imageAllowed(ref string) bool {
+	if ref == s.config.Image {
+		return true
+	}
+	for _, pattern := range s.config.AllowedImages {
+		if imageMatches(ref, pattern) {
+			return true
+		}
+	}
+	return false
+}
+
+// pullImage pulls an image. Pulls of the same ref are one at a time, so jobs
+// starting together don't pull the same image twice.
+func (s *Service) pullImage(ctx context.Context, ref string) (containerd.Image, error) {
+	unlock, err := s.imagePulls.lock(ctx, ref)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	// Pulled by another job while waiting.
+	if image, err := s.containerd.GetImage(ctx, ref); err == nil {
+		return image, nil
+	}
+	log.Printf("Image %s not found. pulling it.", ref)
+	return s.containerd.Pull(ctx, ref, containerd.WithPullUnpack)
+}
+
+// getImage returns the image with the given ref, pulling it if needed, and its config.
+// It doesn't check `allowed_images`, callers must do it for refs coming from scripts.
+// ctx must have the containerd namespace set.
+func (s *Service) getImage(ctx context.Context, ref string) (containerd.Image, *ocispec.Image, error) {
+	image, err := s.containerd.GetImage(ctx, ref)
+	if err != nil {
+		image, err = s.pullImage(ctx, ref)
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+
+	configDesc, err := image.Config(ctx) // aware of img.platform
+	if err != nil {
+		return nil, nil, err
+	}
+
+	s.imageMutex.Lock()
+	imageConfig, ok := s.imageConfigs[configDesc.Digest.String()]
+	s.imageMutex.Unlock()
+	if ok {
+		return image, imageConfig, nil
+	}
+
+	p, err := content.ReadBlob(ctx, image.ContentStore(), configDesc)
+	if err != nil {
+		return nil, nil, err
+	}
+	imageConfig = &ocispec.Image{}
+	if err := json.Unmarshal(p, imageConfig); err != nil {
+		return nil, nil, err
+	}
+
+	// Keyed by digest, so it never goes stale when a tag is re-pushed.
+	s.imageMutex.Lock()
+	s.imageConfigs[configDesc.Digest.String()] = imageConfig
+	s.imageMutex.Unlock()
+
+	return image, imageConfig, nil
+}
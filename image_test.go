@@ -0,0 +1,28 @@
+package main
+
+import "testing"
+
+func TestImageMatches(t *testing.T) {
+	tests := []struct {
+		ref     string
+		pattern string
+		want    bool
+	}{
+		{"embassy.dev/ci:latest", "embassy.dev/ci:latest", true},
+		{"embassy.dev/ci:latest", "embassy.dev/ci:v2", false},
+		{"embassy.dev/ci:latest", "embassy.dev/*", true},
+		{"embassy.dev/tools/ci:latest", "embassy.dev/*", true},
+		{"evil.com/embassy.dev/ci", "embassy.dev/*", false},
+		{"embassy.dev/ci:latest", "*/ci:*", true},
+		{"embassy.dev/ci:latest", "embassy.dev/ci", false},
+		// Only `*` is special, not the rest of regexp syntax.
+		{"embassyxdev/ci", "embassy.dev/*", false},
+		{"embassy.dev/ci", "embassy.dev/c?", false},
+		{"embassy.dev/c?", "embassy.dev/c?", true},
+	}
+	for _, tt := range tests {
+		if got := imageMatches(tt.ref, tt.pattern); got != tt.want {
+			t.Errorf("imageMatches(%q, %q) = %v, want %v", tt.ref, tt.pattern, got, tt.want)
+		}
+	}
+}
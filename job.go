@@ -5,6 +5,7 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
+	"io"
 	"log"
 	"net/http"
 	"os"
@@ -15,11 +16,9 @@ import (
 	"github.com/bradleyfalzon/ghinstallation/v2"
 	"github.com/containerd/containerd"
 	"github.com/containerd/containerd/cio"
-	"github.com/containerd/containerd/content"
 	"github.com/containerd/containerd/namespaces"
 	"github.com/containerd/containerd/oci"
 	"github.com/google/go-github/v52/github"
-	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
 	"github.com/opencontainers/runtime-spec/specs-go"
 	"github.com/sqlbunny/errors"
 )
@@ -31,24 +30,102 @@ func (s *Service) isJobRunning(id string) bool {
 	return isRunning
 }
 
-func (s *Service) setStatus(ctx context.Context, gh *github.Client, j *Job, state string) error {
-	url := fmt.Sprintf("%s/jobs/%s", s.config.ExternalURL, j.ID)
-	_, _, err := gh.Repositories.CreateStatus(ctx,
-		*j.Repo.Owner.Login,
-		*j.Repo.Name,
-		j.SHA,
-		&github.RepoStatus{
-			State:     github.String(state),
-			Context:   github.String(fmt.Sprintf("ci/%s", j.Name)),
-			TargetURL: &url,
-		})
-	return err
+var errInterrupted = errors.New("interrupted by bender restart")
+
+// cancelError is the cause given when cancelling a job. Jobs that fail
+// with it are reported as cancelled instead of failed.
+type cancelError struct {
+	reason string
+}
+
+func (e *cancelError) Error() string {
+	return e.reason
 }
 
-func (s *Service) runJob(ctx context.Context, job *Job) {
+type timeoutError struct {
+	timeout time.Duration
+}
+
+func (e *timeoutError) Error() string {
+	return fmt.Sprintf("timed out after %v", e.timeout)
+}
+
+type oomError struct {
+	limit ByteSize
+}
+
+func (e *oomError) Error() string {
+	return fmt.Sprintf("killed by the OOM killer, memory limit is %v", e.limit)
+}
+
+// How long a timed out job gets to exit after SIGTERM before it's killed.
+const jobKillGracePeriod = 10 * time.Second
+
+// containerJob is the job.json in the job's home. The script can read it, so
+// it doesn't have the job's script, permissions or installation.
+type containerJob struct {
+	Event       string              `json:"event"`
+	Repo        *github.Repository  `json:"repository"`
+	PullRequest *github.PullRequest `json:"pull_request"`
+	ID          string              `json:"id"`
+	Name        string              `json:"name"`
+}
+
+type runningJob struct {
+	job *Job
+	// Done when the job is cancelled, with the cancelError as its cause.
+	ctx    context.Context
+	cancel context.CancelCauseFunc
+	// nil until the job starts.
+	log *jobLog
+}
+
+// newRun returns a copy of the job with a new ID and no run state,
+// for running it again.
+func (j *Job) newRun() *Job {
+	return &Job{
+		Event:           j.Event,
+		ID:              makeJobID(),
+		Name:            j.Name,
+		Script:          j.Script,
+		Permissions:     j.Permissions,
+		PermissionRepos: j.PermissionRepos,
+		Concurrency:     j.Concurrency,
+		Timeout:         j.Timeout,
+		Image:           j.Image,
+		Dockerfile:      j.Dockerfile,
+		Resources:       j.Resources,
+		Matchers:        j.Matchers,
+		State:           JobQueued,
+		CreatedAt:       time.Now(),
+	}
+}
+
+// concurrencyKey identifies runs that supersede each other: same repo,
+// same PR (or branch, for pushes) and same job name.
+func (j *Job) concurrencyKey() string {
+	if j.PullRequest != nil {
+		return fmt.Sprintf("%s pr-%d %s", *j.Repo.FullName, *j.PullRequest.Number, j.Name)
+	}
+	return fmt.Sprintf("%s branch-%s %s", *j.Repo.FullName, j.Attributes["branch"], j.Name)
+}
+
+// addRunningJob registers a job as running before it starts, so cancelJobs
+// can't miss it while it's neither queued nor started.
+func (s *Service) addRunningJob(job *Job) *runningJob {
+	ctx, cancel := context.WithCancelCause(context.Background())
+	r := &runningJob{job: job, ctx: ctx, cancel: cancel}
 	s.runningJobsMutex.Lock()
-	s.runningJobs[job.ID] = struct{}{}
+	s.runningJobs[job.ID] = r
 	s.runningJobsMutex.Unlock()
+	return r
+}
+
+// runJob runs a job registered with addRunningJob.
+func (s *Service) runJob(ctx context.Context, r *runningJob) {
+	job := r.job
+	jobCtx := r.ctx
+	defer r.cancel(nil)
 
 	defer func() {
 		s.runningJobsMutex.Lock()
@@ -56,71 +133,142 @@ func (s *Service) runJob(ctx context.Context, job *Job) {
 		s.runningJobsMutex.Unlock()
 	}()
 
-	logs, err := os.Create(filepath.Join(s.config.DataDir, "logs", job.ID))
+	logs, err := createJobLog(filepath.Join(s.config.DataDir, "logs", job.ID))
 	if err != nil {
 		log.Printf("error creating log file: %v", err)
+		s.finishJob(job, err)
 		return
 	}
+	// Closed after the job is finished, so log followers see its final state.
+	defer logs.Close()
+
+	s.runningJobsMutex.Lock()
+	r.log = logs
+	s.runningJobsMutex.Unlock()
 
 	gh, err := s.githubClient(job.InstallationID)
 	if err != nil {
 		log.Printf("error creating github client: %v", err)
+		s.finishJob(job, err)
+		return
+	}
+
+	if err := context.Cause(jobCtx); err != nil {
+		// Cancelled before it started.
+		fmt.Fprintf(logs, "run cancelled: %v\n", err)
+		log.Printf("job run cancelled: %v", err)
+		s.finishJob(job, err)
+		err = s.reportJob(ctx, gh, job, err)
+		if err != nil {
+			log.Printf("error reporting cancelled job: %v", err)
+		}
 		return
 	}
 
-	err = s.setStatus(ctx, gh, job, "pending")
+	startedAt := time.Now()
+	job.State = JobRunning
+	job.StartedAt = &startedAt
+	s.updateJob(job)
+
+	err = s.reportJob(ctx, gh, job, nil)
 	if err != nil {
-		log.Printf("error creating pending status: %v", err)
+		log.Printf("error reporting running job: %v", err)
 	}
 
 	err = nopanic(func() error {
-		return s.runJobInner(ctx, job, gh, logs)
+		return s.runJobInner(jobCtx, job, gh, logs)
 	})
+	if err != nil && jobCtx.Err() != nil {
+		// Whatever failed, it was because the job was cancelled.
+		err = context.Cause(jobCtx)
+	}
 
-	result := "success"
-	if err != nil {
+	var cancelErr *cancelError
+	if errors.As(err, &cancelErr) {
+		fmt.Fprintf(logs, "run cancelled: %v\n", err)
+		log.Printf("job run cancelled: %v", err)
+	} else if err != nil {
 		fmt.Fprintf(logs, "run failed: %v\n", err)
 		log.Printf("job run failed: %v", err)
-		result = "failure"
 	}
 
-	err = s.setStatus(ctx, gh, job, result)
+	sections, leftOut, sectionsErr := s.jobLogSections(job, err != nil)
+	if sectionsErr != nil {
+		log.Printf("failed to find log sections: %v", sectionsErr)
+	}
+	job.Sections = sections
+	job.SectionsLeftOut = leftOut
+	s.finishJob(job, err)
+	s.queueLogIndex()
+
+	err = s.reportJob(ctx, gh, job, err)
 	if err != nil {
-		log.Printf("error creating result status: %v", err)
+		log.Printf("error reporting job result: %v", err)
 	}
 }
 
-func (s *Service) runJobInner(ctx context.Context, job *Job, gh *github.Client, logs *os.File) error {
-	token, err := s.getRepoToken(ctx, job)
+// updateJob persists the job's current state to the db.
+func (s *Service) updateJob(job *Job) {
+	err := s.db.saveJob(job)
 	if err != nil {
-		return err
+		log.Printf("error saving job %s: %v", job.ID, err)
 	}
-	log.Printf("repo token: %s", token)
-
-	ctx = namespaces.WithNamespace(ctx, "bender")
+}
 
-	image, err := s.containerd.GetImage(ctx, s.config.Image)
-	if err != nil {
-		log.Println("Image not found. pulling it. ", err)
-		image, err = s.containerd.Pull(ctx, s.config.Image, containerd.WithPullUnpack)
-		if err != nil {
-			return err
-		}
+func (s *Service) finishJob(job *Job, err error) {
+	finishedAt := time.Now()
+	job.FinishedAt = &finishedAt
+	var cancelErr *cancelError
+	if errors.As(err, &cancelErr) {
+		job.State = JobCancelled
+		job.Error = err.Error()
+	} else if err != nil {
+		job.State = JobFailure
+		job.Error = err.Error()
+	} else {
+		job.State = JobSuccess
 	}
+	s.updateJob(job)
+}
 
-	// Read image imageConfig.
-	var imageConfig ocispec.Image
-	configDesc, err := image.Config(ctx) // aware of img.platform
-	if err != nil {
+// runJobInner runs the job's container. If jobCtx is cancelled, the container
+// is killed and the cause is returned.
+func (s *Service) runJobInner(jobCtx context.Context, job *Job, gh *github.Client, logs io.Writer) error {
+	// The timeout starts now, so pulling or building the image counts too.
+	timeout := job.Timeout
+	if timeout == 0 {
+		timeout = s.config.DefaultJobTimeout
+	}
+	var timeoutC <-chan time.Time
+	// jobCtx, also done when the job times out. Only for what runs before the
+	// job's task, which is stopped more gracefully.
+	setupCtx := jobCtx
+	if timeout != 0 {
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+		timeoutC = timer.C
+
+		var cancel context.CancelFunc
+		setupCtx, cancel = context.WithTimeout(jobCtx, timeout)
+		defer cancel()
+	}
+	setupErr := func(err error) error {
+		if jobCtx.Err() == nil && setupCtx.Err() != nil {
+			fmt.Fprintf(logs, "\ntimed out after %v\n", timeout)
+			return &timeoutError{timeout}
+		}
 		return err
 	}
-	p, err := content.ReadBlob(ctx, image.ContentStore(), configDesc)
+
+	token, err := s.getRepoToken(jobCtx, job)
 	if err != nil {
 		return err
 	}
-	if err := json.Unmarshal(p, &imageConfig); err != nil {
-		return err
-	}
+	log.Printf("repo token: %s", token)
+
+	// containerd calls don't use jobCtx, so that cleanup still works
+	// after the job is cancelled.
+	ctx := namespaces.WithNamespace(context.Background(), "bender")
 
 	log.Println("creating container")
 
@@ -143,6 +291,28 @@ func (s *Service) runJobInner(ctx context.Context, job *Job, gh *github.Client,
 		}
 	}()
 
+	var imageRef string
+	if job.Dockerfile != "" {
+		imageRef, err = s.buildImage(setupCtx, ctx, job, gh, jobDir, logs)
+		if err != nil {
+			return setupErr(err)
+		}
+		// Used again when the job finishes, so it's kept while the job runs.
+		defer s.markBuiltImageUsed(ctx, imageRef)
+	} else {
+		imageRef = job.Image
+		if imageRef == "" {
+			imageRef = s.config.Image
+		}
+		if !s.imageAllowed(imageRef) {
+			return errors.Errorf("image '%s' is not allowed", imageRef)
+		}
+	}
+	image, imageConfig, err := s.getImage(namespaces.WithNamespace(setupCtx, "bender"), imageRef)
+	if err != nil {
+		return setupErr(err)
+	}
+
 	// Setup cache
 	cacheDir := filepath.Join(s.config.DataDir, "cache", *job.Repo.Owner.Login, *job.Repo.Name, job.Name)
 	err = os.MkdirAll(cacheDir, 0700)
@@ -231,7 +401,13 @@ detachedHead = false
 		return err
 	}
 
-	j, err := json.Marshal(job)
+	j, err := json.Marshal(containerJob{
+		Event:       job.Event.Event,
+		Repo:        job.Repo,
+		PullRequest: job.PullRequest,
+		ID:          job.ID,
+		Name:        job.Name,
+	})
 	if err != nil {
 		return err
 	}
@@ -267,21 +443,7 @@ detachedHead = false
 		},
 	}
 
-	if s.config.NetSandbox != nil {
-		mounts = append(mounts, specs.Mount{
-			Type:        "none",
-			Source:      filepath.Join(s.config.DataDir, "resolv.conf"),
-			Destination: "/etc/resolv.conf",
-			Options:     []string{"rbind", "ro"},
-		})
-	} else {
-		mounts = append(mounts, specs.Mount{
-			Type:        "none",
-			Source:      "/etc/resolv.conf",
-			Destination: "/etc/resolv.conf",
-			Options:     []string{"rbind", "ro"},
-		})
-	}
+	mounts = append(mounts, s.resolvConfMount())
 
 	if job.Trusted {
 		secretPath := filepath.Join(s.config.DataDir, "secrets", *job.Repo.Owner.Login, *job.Repo.Name)
@@ -300,7 +462,12 @@ detachedHead = false
 
 	// setup cgroup
 	jobName := fmt.Sprintf("job-%s", job.ID)
-	cgroup := filepath.Join(s.cgroup.jobs, jobName)
+	resources := s.jobResources(job)
+	fmt.Fprintf(logs, "resource limits: cpu=%v memory=%v pids=%v\n", resources.CPU, resources.Memory, resources.Pids)
+	cgroup, err := s.cgroup.createJob(jobName, resources)
+	if err != nil {
+		return err
+	}
 
 	container, err := s.containerd.NewContainer(ctx, jobName,
 		containerd.WithNewSnapshot(fmt.Sprintf("job-%s-rootfs", job.ID), image),
@@ -322,7 +489,7 @@ detachedHead = false
 	if err != nil {
 		return err
 	}
-	defer container.Delete(ctx)
+	defer container.Delete(ctx, containerd.WithSnapshotCleanup)
 
 	log.Println("creating task")
 
@@ -350,13 +517,53 @@ detachedHead = false
 		return err
 	}
 
+	// Deferred after task.Delete, so it runs first and gets the last sample before the cgroup is gone.
+	sampler := s.cgroup.startSampling(cgroup)
+	defer func() {
+		job.Stats = sampler.stop()
+	}()
+
 	// wait for the task to exit and get the exit status
 	statusC, err := task.Wait(ctx)
 	if err != nil {
 		return err
 	}
 
-	status := <-statusC
+	// Don't commit the cache or publish artifacts of cancelled or timed out jobs.
+	var status containerd.ExitStatus
+	select {
+	case status = <-statusC:
+	case <-jobCtx.Done():
+		log.Printf("job cancelled, killing task")
+		err = task.Kill(ctx, syscall.SIGKILL)
+		if err != nil {
+			log.Printf("failed to kill task: %v", err)
+		}
+		<-statusC
+		return context.Cause(jobCtx)
+	case <-timeoutC:
+		log.Printf("job timed out, stopping task")
+		fmt.Fprintf(logs, "\ntimed out after %v, stopping job\n", timeout)
+		err = task.Kill(ctx, syscall.SIGTERM, containerd.WithKillAll)
+		if err != nil {
+			log.Printf("failed to stop task: %v", err)
+		}
+		select {
+		case <-statusC:
+		case <-time.After(jobKillGracePeriod):
+			fmt.Fprintf(logs, "job didn't stop after %v, killing it\n", jobKillGracePeriod)
+			err = task.Kill(ctx, syscall.SIGKILL, containerd.WithKillAll)
+			if err != nil {
+				log.Printf("failed to kill task: %v", err)
+			}
+			<-statusC
+		}
+		return &timeoutError{timeout}
+	}
+	if status.Error() == nil {
+		exitCode := int(status.ExitCode())
+		job.ExitCode = &exitCode
+	}
 
 	// Commit cache
 	primary := job.Cache[0]
@@ -383,10 +590,9 @@ detachedHead = false
 	if err != nil {
 		log.Printf("failed to remove symlinks in artifact dir: %v", err)
 	} else {
-		artifactsDir := filepath.Join(s.config.DataDir, "artifacts", job.ID)
-		err = os.Rename(jobArtifactsDir, artifactsDir)
+		err = s.publishArtifacts(job, jobArtifactsDir, logs)
 		if err != nil {
-			log.Printf("failed to rename artifact dir: %v", err)
+			log.Printf("failed to publish artifacts: %v", err)
 		}
 	}
 
@@ -400,11 +606,33 @@ detachedHead = false
 		return err
 	}
 	if status.ExitCode() != 0 {
+		if s.cgroup.oomKilled(cgroup) {
+			return &oomError{resources.Memory}
+		}
 		return errors.Errorf("exited with code %d", status.ExitCode())
 	}
 	return nil
 }
 
+func (s *Service) jobResources(job *Job) Resources {
+	return job.Resources.merge(s.config.Resources.Default, s.config.Resources.Max)
+}
+
+// resolvConfMount returns the /etc/resolv.conf mount for job containers,
+// pointing to our DNS server if the network sandbox is enabled.
+func (s *Service) resolvConfMount() specs.Mount {
+	source := "/etc/resolv.conf"
+	if s.config.NetSandbox != nil {
+		source = filepath.Join(s.config.DataDir, "resolv.conf")
+	}
+	return specs.Mount{
+		Type:        "none",
+		Source:      source,
+		Destination: "/etc/resolv.conf",
+		Options:     []string{"rbind", "ro"},
+	}
+}
+
 func (s *Service) postComment(ctx context.Context, job *Job, gh *github.Client, home string) error {
 	if job.PullRequest == nil {
 		return nil
@@ -0,0 +1,246 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"html"
+	"io"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// logTimes reads the times a job's log lines started, from the `.times` file
+// next to the log. It has one line per log line, with the milliseconds since
+// the job started. Logs from before it existed have no times.
+type logTimes struct {
+	f     *os.File
+	buf   []byte
+	times []time.Duration
+}
+
+func openLogTimes(logPath string) *logTimes {
+	f, err := os.Open(logPath + ".times")
+	if err != nil && !os.IsNotExist(err) {
+		log.Printf("failed to open log times: %v", err)
+	}
+	if err != nil {
+		return &logTimes{}
+	}
+	return &logTimes{f: f}
+}
+
+// get returns when the line with the given index started.
+func (t *logTimes) get(line int) (time.Duration, bool) {
+	if line >= len(t.times) && t.f != nil {
+		// The job is still running, the times file may have grown.
+		t.read()
+	}
+	if line >= len(t.times) {
+		return 0, false
+	}
+	return t.times[line], true
+}
+
+func (t *logTimes) read() {
+	buf := make([]byte, 32*1024)
+	for {
+		n, err := t.f.Read(buf)
+		t.buf = append(t.buf, buf[:n]...)
+		if n == 0 || err != nil {
+			if err != nil && err != io.EOF {
+				log.Printf("failed to read log times: %v", err)
+			}
+			break
+		}
+	}
+
+	for {
+		i := bytes.IndexByte(t.buf, '\n')
+		if i < 0 {
+			break
+		}
+		ms, err := strconv.ParseInt(string(t.buf[:i]), 10, 64)
+		if err != nil {
+			log.Printf("invalid log time '%s'", t.buf[:i])
+		}
+		t.times = append(t.times, time.Duration(ms)*time.Millisecond)
+		t.buf = t.buf[i+1:]
+	}
+}
+
+func (t *logTimes) Close() {
+	if t.f != nil {
+		t.f.Close()
+	}
+}
+
+// logRenderer renders a job's log as HTML, with a line per element so they
+// have line numbers, `#L<n>` anchors and times, and sections as collapsible
+// `<details>` elements.
+type logRenderer struct {
+	conv  ansiConverter
+	times *logTimes
+	// The sections of the finished job, for their durations and to expand the
+	// failed one.
+	known []LogSection
+	// Whether the output of each Write must be valid HTML by itself. If so,
+	// lines in a section that started in a previous Write are wrapped in a
+	// `gc` element, to be moved into the section's element.
+	balanced bool
+
+	// Lines rendered so far.
+	line int
+	// Whether the last line rendered wasn't complete, because it was too long.
+	open bool
+
+	sections  []LogSection
+	inSection bool
+}
+
+func newLogRenderer(logPath string, known []LogSection) *logRenderer {
+	return &logRenderer{
+		times: openLogTimes(logPath),
+		known: known,
+	}
+}
+
+// Write renders the complete lines in p, along with the input held back
+// from previous calls.
+func (r *logRenderer) Write(p []byte) string {
+	return r.lines(r.conv.Convert(p))
+}
+
+// Flush renders all the input held back, for when there's no more.
+func (r *logRenderer) Flush() string {
+	return r.lines(r.conv.Flush())
+}
+
+// Buffered returns the number of input bytes held back.
+func (r *logRenderer) Buffered() int {
+	return r.conv.Buffered()
+}
+
+// unclosed returns the HTML to close the section being rendered, if any,
+// for when rendering stops before the end of the log.
+func (r *logRenderer) unclosed() string {
+	if r.inSection && !r.balanced {
+		return "</details>"
+	}
+	return ""
+}
+
+// endSection ends the section being rendered, if any, at the end of the log.
+func (r *logRenderer) endSection(failed bool) {
+	if r.inSection {
+		last := r.line
+		if r.open {
+			last++
+		}
+		r.endSectionAt(last, failed)
+	}
+}
+
+func (r *logRenderer) endSectionAt(line int, failed bool) *LogSection {
+	sec := &r.sections[len(r.sections)-1]
+	sec.EndLine = line
+	if t, ok := r.times.get(line - 1); ok {
+		sec.Duration = t - sec.Start
+	}
+	sec.Failed = failed
+	r.inSection = false
+	return sec
+}
+
+func (r *logRenderer) Close() {
+	r.times.Close()
+}
+
+func (r *logRenderer) lines(s string) string {
+	var out strings.Builder
+	closer := "</details>"
+	if r.balanced && r.inSection && s != "" {
+		out.WriteString(`<div class="gc">`)
+		closer = "</div>"
+	}
+
+	for s != "" {
+		line, rest, complete := strings.Cut(s, "\n")
+		s = rest
+
+		if r.open {
+			// Rest of a long line, it keeps its number.
+			fmt.Fprintf(&out, `<div class="l">%s</div>`, line)
+		} else {
+			n := r.line + 1
+			start, end, name := groupMarker(htmlText(line))
+			switch {
+			case start:
+				if r.inSection {
+					r.endSectionAt(n-1, false)
+					out.WriteString(closer)
+					closer = "</details>"
+				}
+				t, _ := r.times.get(n - 1)
+				r.sections = append(r.sections, LogSection{Name: name, StartLine: n, EndLine: n, Start: t})
+				r.inSection = true
+
+				open, duration := "", ""
+				for _, k := range r.known {
+					if k.StartLine == n {
+						if k.Failed {
+							open = " open"
+						}
+						duration = formatElapsed(k.Duration)
+					}
+				}
+				fmt.Fprintf(&out, `<details class="g" id="G%d"%s><summary>`, n, open)
+				r.writeLine(&out, n, "l", html.EscapeString(name)+`<span class="d">`+duration+`</span>`)
+				out.WriteString("</summary>")
+			case end && r.inSection:
+				r.writeLine(&out, n, "l m", line)
+				sec := r.endSectionAt(n, false)
+				out.WriteString(closer)
+				closer = "</details>"
+				// For the page's script to show the duration in the summary,
+				// which was rendered before it was known.
+				fmt.Fprintf(&out, `<span class="gd" hidden data-g="G%d">%s</span>`, sec.StartLine, formatElapsed(sec.Duration))
+			default:
+				r.writeLine(&out, n, "l", line)
+			}
+		}
+
+		if complete {
+			r.line++
+		}
+		r.open = !complete
+	}
+
+	if r.balanced && r.inSection && out.Len() != 0 {
+		out.WriteString(closer)
+	}
+	return out.String()
+}
+
+// writeLine writes the element for line n, with the given HTML content.
+func (r *logRenderer) writeLine(out *strings.Builder, n int, class string, content string) {
+	t := ""
+	if d, ok := r.times.get(n - 1); ok {
+		t = formatElapsed(d)
+	}
+	fmt.Fprintf(out, `<div class="%s" id="L%d"><a class="n" href="#L%d">%d</a><span class="t">%s</span>%s</div>`, class, n, n, n, t, content)
+}
+
+// formatElapsed formats a duration like a stopwatch, as h:mm:ss.s or m:ss.s.
+func formatElapsed(d time.Duration) string {
+	d = d.Round(100 * time.Millisecond)
+	h := int(d / time.Hour)
+	m := int(d/time.Minute) % 60
+	s := float64(d%time.Minute) / float64(time.Second)
+	if h > 0 {
+		return fmt.Sprintf("%d:%02d:%04.1f", h, m, s)
+	}
+	return fmt.Sprintf("%d:%04.1f", m, s)
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLogRenderer(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "log")
+	if err := os.WriteFile(path+".times", []byte("0\n1500\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	r := newLogRenderer(path, nil)
+	defer r.Close()
+	got := r.Write([]byte("a\nb\nc"))
+	got += r.Flush()
+	want := `<div class="l" id="L1"><a class="n" href="#L1">1</a><span class="t">0:00.0</span>a</div>` +
+		`<div class="l" id="L2"><a class="n" href="#L2">2</a><span class="t">0:01.5</span>b</div>` +
+		`<div class="l" id="L3"><a class="n" href="#L3">3</a><span class="t"></span>c</div>`
+	if got != want {
+		t.Errorf("got:\n%s\nwant:\n%s", got, want)
+	}
+}
+
+func TestFormatElapsed(t *testing.T) {
+	for _, tc := range []struct {
+		d    time.Duration
+		want string
+	}{
+		{0, "0:00.0"},
+		{1234 * time.Millisecond, "0:01.2"},
+		{59*time.Second + 960*time.Millisecond, "1:00.0"},
+		{2*time.Hour + 3*time.Minute + 4*time.Second, "2:03:04.0"},
+	} {
+		if got := formatElapsed(tc.d); got != tc.want {
+			t.Errorf("formatElapsed(%v) = %s, want %s", tc.d, got, tc.want)
+		}
+	}
+}
+
+func TestLogRendererSections(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "log")
+	if err := os.WriteFile(path+".times", []byte("0\n1000\n3000\n3000\n5000\n6000\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	r := newLogRenderer(path, nil)
+	defer r.Close()
+	r.balanced = true
+	got := r.Write([]byte("a\n##[group]Build\nb\n"))
+	got += r.Write([]byte("::endgroup::\n::group::Test\nc\n"))
+	r.endSection(true)
+
+	want := `<div class="l" id="L1"><a class="n" href="#L1">1</a><span class="t">0:00.0</span>a</div>` +
+		`<details class="g" id="G2"><summary><div class="l" id="L2"><a class="n" href="#L2">2</a><span class="t">0:01.0</span>Build<span class="d"></span></div></summary>` +
+		`<div class="l" id="L3"><a class="n" href="#L3">3</a><span class="t">0:03.0</span>b</div></details>` +
+		`<div class="gc"><div class="l m" id="L4"><a class="n" href="#L4">4</a><span class="t">0:03.0</span>::endgroup::</div></div>` +
+		`<span class="gd" hidden data-g="G2">0:02.0</span>` +
+		`<details class="g" id="G5"><summary><div class="l" id="L5"><a class="n" href="#L5">5</a><span class="t">0:05.0</span>Test<span class="d"></span></div></summary>` +
+		`<div class="l" id="L6"><a class="n" href="#L6">6</a><span class="t">0:06.0</span>c</div></details>`
+	if got != want {
+		t.Errorf("got:\n%s\nwant:\n%s", got, want)
+	}
+
+	wantSections := []LogSection{
+		{Name: "Build", StartLine: 2, EndLine: 4, Start: time.Second, Duration: 2 * time.Second},
+		{Name: "Test", StartLine: 5, EndLine: 6, Start: 5 * time.Second, Duration: time.Second, Failed: true},
+	}
+	if !reflect.DeepEqual(r.sections, wantSections) {
+		t.Errorf("got sections %+v, want %+v", r.sections, wantSections)
+	}
+}
+
+func TestCapSections(t *testing.T) {
+	var sections []LogSection
+	for i := 0; i < jobMaxSections+100; i++ {
+		sections = append(sections, LogSection{Name: strings.Repeat("x", jobMaxSectionName+10), StartLine: i + 1})
+	}
+	sections[len(sections)-1].Failed = true
+
+	got, leftOut := capSections(sections)
+	if len(got) != jobMaxSections || leftOut != 100 {
+		t.Fatalf("got %d sections, %d left out, want %d and 100", len(got), leftOut, jobMaxSections)
+	}
+	if last := got[len(got)-1]; !last.Failed || last.StartLine != jobMaxSections+100 {
+		t.Errorf("the last section isn't kept: %+v", last)
+	}
+	if n := len([]rune(got[0].Name)); n != jobMaxSectionName+1 {
+		t.Errorf("got a name of %d characters, want %d", n, jobMaxSectionName+1)
+	}
+}
@@ -0,0 +1,320 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/sqlbunny/errors"
+)
+
+// jobLog is the log file of a running job. Readers following the log wait
+// on it for new writes, instead of polling the file.
+//
+// It also records when each line started, relative to the job start, in a
+// separate file: see logTimes.
+type jobLog struct {
+	f     *os.File
+	times *os.File
+	start time.Time
+
+	mutex       sync.Mutex
+	done        bool
+	atLineStart bool
+	// closed and replaced on every write.
+	changed chan struct{}
+}
+
+func createJobLog(path string) (*jobLog, error) {
+	f, err := os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+	times, err := os.Create(path + ".times")
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return &jobLog{
+		f:           f,
+		times:       times,
+		start:       time.Now(),
+		atLineStart: true,
+		changed:     make(chan struct{}),
+	}, nil
+}
+
+func (l *jobLog) Write(p []byte) (int, error) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	// Times first, so readers never see a line without its time.
+	var times []byte
+	elapsed := time.Since(l.start).Milliseconds()
+	for _, b := range p {
+		if l.atLineStart {
+			times = strconv.AppendInt(times, elapsed, 10)
+			times = append(times, '\n')
+		}
+		l.atLineStart = b == '\n'
+	}
+	if len(times) != 0 {
+		if _, err := l.times.Write(times); err != nil {
+			log.Printf("failed to write log times: %v", err)
+		}
+	}
+
+	n, err := l.f.Write(p)
+	if n > 0 {
+		close(l.changed)
+		l.changed = make(chan struct{})
+	}
+	return n, err
+}
+
+// Close closes the files and wakes up the readers, so they see the log is done.
+func (l *jobLog) Close() error {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	l.done = true
+	close(l.changed)
+	l.times.Close()
+	return l.f.Close()
+}
+
+// wait returns whether the log is done, and if not, a channel that's closed
+// on the next write.
+func (l *jobLog) wait() (bool, <-chan struct{}) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	return l.done, l.changed
+}
+
+// runningJobLog returns the log of a running job, or nil if it's not running.
+func (s *Service) runningJobLog(id string) *jobLog {
+	s.runningJobsMutex.Lock()
+	defer s.runningJobsMutex.Unlock()
+	if r, ok := s.runningJobs[id]; ok {
+		return r.log
+	}
+	return nil
+}
+
+// followLog calls f with the job's log starting at offset, as it's written,
+// until the job finishes or ctx is done.
+func (s *Service) followLog(ctx context.Context, jobID string, offset int64, f func([]byte) error) error {
+	file, err := openLogAt(filepath.Join(s.config.DataDir, "logs", jobID), offset)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	buf := make([]byte, 32*1024)
+	for {
+		// Check before reading, so writes done while reading aren't missed.
+		done := true
+		var changed <-chan struct{}
+		if l := s.runningJobLog(jobID); l != nil {
+			done, changed = l.wait()
+		}
+
+		for {
+			n, err := file.Read(buf)
+			if n > 0 {
+				if err := f(buf[:n]); err != nil {
+					return err
+				}
+			}
+			if errors.Is(err, io.EOF) || n == 0 {
+				break
+			}
+			if err != nil {
+				return err
+			}
+		}
+
+		if done {
+			return nil
+		}
+		select {
+		case <-changed:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// splitUTF8 splits p before an incomplete UTF-8 sequence at its end, if any.
+func splitUTF8(p []byte) ([]byte, []byte) {
+	for i := 1; i <= utf8.UTFMax && i <= len(p); i++ {
+		c := p[len(p)-i]
+		if c < utf8.RuneSelf {
+			// ASCII, nothing incomplete after it.
+			return p, nil
+		}
+		if utf8.RuneStart(c) {
+			if !utf8.FullRune(p[len(p)-i:]) {
+				return p[:len(p)-i], p[len(p)-i:]
+			}
+			return p, nil
+		}
+	}
+	return p, nil
+}
+
+// jobInfo returns the one-line description at the top of the job's log page.
+func jobInfo(job *Job) string {
+	info := fmt.Sprintf("%s %s @ %s: %s", *job.Repo.FullName, job.Name, job.SHA, job.State)
+	if a := job.TrustedBy; a != nil {
+		info += fmt.Sprintf(" (trusted by @%s on %s)", a.User, a.CreatedAt.UTC().Format("2006-01-02 15:04 UTC"))
+	}
+	return info
+}
+
+// jobStatsText returns the resource usage summary shown after the log, or "" if there's none.
+func jobStatsText(job *Job) string {
+	if job == nil || job.Stats == nil {
+		return ""
+	}
+	res := "\nresource usage:\n"
+	for _, line := range job.Stats.summary() {
+		res += "  " + line + "\n"
+	}
+	return res
+}
+
+// HandleJobLogEvents streams the job's log as server-sent events, with the
+// log as HTML lines, like in the log page. Each `log` event's ID is the log offset after it, so clients
+// resume where they were when they reconnect. An `end` event with the job's
+// final info is sent when it finishes. Lines in a section that started
+// before the event are wrapped in a `gc` element, see logRenderer.
+func (s *Service) HandleJobLogEvents(w http.ResponseWriter, r *http.Request) {
+	jobID := chi.URLParam(r, "jobID")
+	if !validJobID(jobID) {
+		http.Error(w, http.StatusText(404), 404)
+		return
+	}
+
+	var offset int64
+	from := r.Header.Get("Last-Event-ID")
+	if from == "" {
+		from = r.URL.Query().Get("offset")
+	}
+	if from != "" {
+		var err error
+		offset, err = strconv.ParseInt(from, 10, 64)
+		if err != nil || offset < 0 {
+			http.Error(w, "invalid offset", 400)
+			return
+		}
+	}
+
+	job, err := s.db.getJob(jobID)
+	if err != nil {
+		log.Printf("failed to get job: %v", err)
+	}
+	var known []LogSection
+	if job != nil {
+		known = job.Sections
+	}
+	logPath := filepath.Join(s.config.DataDir, "logs", jobID)
+	lines, err := logRendererAt(logPath, offset, known)
+	if os.IsNotExist(err) {
+		http.Error(w, http.StatusText(404), 404)
+		return
+	} else if err != nil {
+		log.Printf("failed to read log: %v", err)
+		http.Error(w, http.StatusText(500), 500)
+		return
+	}
+	defer lines.Close()
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming not supported", 500)
+		return
+	}
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	// Tell nginx not to buffer it.
+	w.Header().Set("X-Accel-Buffering", "no")
+
+	read := offset
+	send := func(html string) error {
+		if html == "" {
+			return nil
+		}
+		j, _ := json.Marshal(html)
+		_, err := fmt.Fprintf(w, "id: %d\nevent: log\ndata: %s\n\n", read-int64(lines.Buffered()), j)
+		flusher.Flush()
+		return err
+	}
+	err = s.followLog(r.Context(), jobID, offset, func(chunk []byte) error {
+		read += int64(len(chunk))
+		return send(lines.Write(chunk))
+	})
+	if err == nil {
+		err = send(lines.Flush())
+	}
+	if r.Context().Err() != nil {
+		return
+	}
+	if err != nil {
+		log.Printf("failed to stream log: %v", err)
+		fmt.Fprintf(w, "event: error\ndata: \"failed to read log\"\n\n")
+		return
+	}
+
+	end := map[string]string{}
+	if job, err := s.db.getJob(jobID); err == nil && job != nil {
+		end["info"] = jobInfo(job)
+		end["stats"] = jobStatsText(job)
+		for _, sec := range job.Sections {
+			if sec.Failed {
+				end["failed_section"] = fmt.Sprintf("G%d", sec.StartLine)
+			}
+		}
+	}
+	j, _ := json.Marshal(end)
+	fmt.Fprintf(w, "event: end\ndata: %s\n\n", j)
+	flusher.Flush()
+}
+
+// logRendererAt returns a renderer for the log starting at offset, in the
+// state it'd be in after rendering the log before it: line numbers, colors
+// and sections continue where they were.
+func logRendererAt(logPath string, offset int64, known []LogSection) (*logRenderer, error) {
+	f, err := openLog(logPath)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	r := newLogRenderer(logPath, known)
+	buf := make([]byte, 32*1024)
+	in := io.LimitReader(f, offset)
+	for {
+		n, err := in.Read(buf)
+		r.Write(buf[:n])
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			r.Close()
+			return nil, err
+		}
+	}
+	r.balanced = true
+	return r, nil
+}
@@ -0,0 +1,24 @@
+package main
+
+import "testing"
+
+func TestSplitUTF8(t *testing.T) {
+	for _, tc := range []struct {
+		in, data, rest string
+	}{
+		{"", "", ""},
+		{"abc", "abc", ""},
+		{"ab\xc3\xa9", "ab\xc3\xa9", ""},
+		{"ab\xc3", "ab", "\xc3"},
+		{"ab\xe2\x82", "ab", "\xe2\x82"},
+		{"\xf0\x9f\x98", "", "\xf0\x9f\x98"},
+		{"\xf0\x9f\x98\x80", "\xf0\x9f\x98\x80", ""},
+		// Invalid, sent as is.
+		{"ab\x80\x80", "ab\x80\x80", ""},
+	} {
+		data, rest := splitUTF8([]byte(tc.in))
+		if string(data) != tc.data || string(rest) != tc.rest {
+			t.Errorf("splitUTF8(%q) = %q, %q, want %q, %q", tc.in, data, rest, tc.data, tc.rest)
+		}
+	}
+}
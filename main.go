@@ -6,9 +6,11 @@ import (
 	"os"
 	"path/filepath"
 	"sync"
+	"time"
 
 	"github.com/containerd/containerd"
 	"github.com/google/go-github/v52/github"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
 	"gopkg.in/yaml.v3"
 )
 
@@ -20,6 +22,101 @@ type Config struct {
 	Image       string            `yaml:"image"`
 	Github      GithubConfig      `yaml:"github"`
 	Cache       CacheConfig       `yaml:"cache"`
+
+	// What to do on startup with jobs that were running when bender stopped:
+	// "error" marks their GitHub status as errored, "requeue" runs them again.
+	OrphanedJobs string `yaml:"orphaned_jobs"`
+	// Maximum number of jobs running at once. 0 means no limit.
+	MaxConcurrentJobs int `yaml:"max_concurrent_jobs"`
+	// Timeout for jobs without a `## timeout` directive. 0 means no timeout.
+	DefaultJobTimeout time.Duration `yaml:"default_job_timeout"`
+	// Images jobs can pick with the `## image` directive, in addition to `image`.
+	// `*` matches anything, e.g. `embassy.dev/*`.
+	AllowedImages []string `yaml:"allowed_images"`
+	// Kaniko image used to build images for the `## dockerfile` directive.
+	ImageBuilder string `yaml:"image_builder"`
+	// Built images that no job used for this long are deleted. 0 means never.
+	BuiltImagesExpire time.Duration   `yaml:"built_images_expire"`
+	Resources         ResourcesConfig `yaml:"resources"`
+	// Report jobs with commit statuses instead of check runs.
+	UseStatuses bool `yaml:"use_statuses"`
+	// Don't run untrusted PRs from authors who have never contributed to the repo
+	// until a maintainer approves them with `bender approve`.
+	NewContributorApproval bool `yaml:"new_contributor_approval"`
+	// Token for the write endpoints of the API, sent as `Authorization: Bearer <token>`.
+	// Empty disables them.
+	APIToken string `yaml:"api_token"`
+	// What to keep of finished jobs.
+	Retention RetentionConfig `yaml:"retention"`
+	Artifacts ArtifactsConfig `yaml:"artifacts"`
+}
+
+type ArtifactsConfig struct {
+	// Policy for repos not in Repos.
+	ArtifactsPolicy `yaml:",inline"`
+	// Policies for specific repos, by "owner/name".
+	Repos map[string]ArtifactsPolicy `yaml:"repos"`
+	// Where artifacts are kept.
+	Store ArtifactStoreConfig `yaml:"store"`
+}
+
+type ArtifactStoreConfig struct {
+	// "filesystem" (the default) keeps artifacts in the data dir, "s3" in an
+	// S3-compatible bucket.
+	Type string           `yaml:"type"`
+	S3   S3ArtifactConfig `yaml:"s3"`
+}
+
+type S3ArtifactConfig struct {
+	// Like https://s3.eu-west-1.amazonaws.com, or http://localhost:9000 for MinIO.
+	Endpoint string `yaml:"endpoint"`
+	// Default us-east-1.
+	Region string `yaml:"region"`
+	Bucket string `yaml:"bucket"`
+	// Prepended to the object keys, like "bender/".
+	Prefix          string `yaml:"prefix"`
+	AccessKeyID     string `yaml:"access_key_id"`
+	SecretAccessKey string `yaml:"secret_access_key"`
+	// Address the bucket as <endpoint>/<bucket> instead of <bucket>.<endpoint host>.
+	// MinIO needs this.
+	PathStyle bool `yaml:"path_style"`
+	// How long the download links bender redirects to work. Default 1h, max 7 days.
+	URLExpiry time.Duration `yaml:"url_expiry"`
+}
+
+type ArtifactsPolicy struct {
+	// Maximum total size of a job's artifacts. Bigger artifacts aren't kept. 0 means no limit.
+	MaxJobSizeMB int `yaml:"max_job_size_mb"`
+	// Maximum total size of the artifacts of all the repo's jobs. Artifacts that
+	// don't fit aren't kept. 0 means no limit.
+	MaxRepoSizeMB int `yaml:"max_repo_size_mb"`
+	// How long to keep artifacts after the job finishes. 0 means as long as the
+	// retention policy keeps the job's log.
+	Expire time.Duration `yaml:"expire"`
+}
+
+type RetentionConfig struct {
+	// Compress the logs of finished jobs with gzip.
+	CompressLogs bool `yaml:"compress_logs"`
+	// Policy for repos not in Repos.
+	RetentionPolicy `yaml:",inline"`
+	// Policies for specific repos, by "owner/name".
+	Repos map[string]RetentionPolicy `yaml:"repos"`
+}
+
+type RetentionPolicy struct {
+	// How long to keep the logs and artifacts of jobs that didn't fail,
+	// successful and cancelled ones, after they finish. 0 means forever.
+	Success time.Duration `yaml:"success"`
+	// How long to keep the logs and artifacts of failed jobs. 0 means forever.
+	Failure time.Duration `yaml:"failure"`
+}
+
+type ResourcesConfig struct {
+	// Limits for jobs that don't set them with the `## resources` directive.
+	Default Resources `yaml:"default"`
+	// Maximum limits a job can set with the `## resources` directive.
+	Max Resources `yaml:"max"`
 }
 
 type CacheConfig struct {
@@ -40,41 +137,98 @@ type GithubConfig struct {
 type Service struct {
 	config     Config
 	containerd *containerd.Client
+	db         *DB
 
 	runningJobsMutex sync.Mutex
-	runningJobs      map[string]struct{}
+	runningJobs      map[string]*runningJob
+
+	queueMutex sync.Mutex
+	queue      jobQueue
 
 	cgroup Cgroup
+
+	imageMutex sync.Mutex
+	// image config digest -> config
+	imageConfigs map[string]*ocispec.Image
+	// Held while pulling an image, by ref.
+	imagePulls keyedMutex
+
+	// Held while building an image, by ref.
+	builds keyedMutex
+
+	artifacts ArtifactStore
+	// Held while checking artifacts against the repo quota.
+	artifactsMutex sync.Mutex
+
+	// Tells logIndexRun that jobs finished, so their logs must be indexed.
+	logIndexQueue chan struct{}
 }
 
 type Event struct {
 	Event      string            `json:"event"`
-	Attributes map[string]string `json:"-"`
+	Attributes map[string]string `json:"attributes"`
 
 	Repo           *github.Repository  `json:"repository"`
 	PullRequest    *github.PullRequest `json:"pull_request"`
-	CloneURL       string              `json:"-"`
-	SHA            string              `json:"-"`
-	InstallationID int64               `json:"-"`
+	CloneURL       string              `json:"clone_url"`
+	SHA            string              `json:"sha"`
+	InstallationID int64               `json:"installation_id"`
 
 	// Cache[0] is the primary cache, Cache[1:] are secondary caches
 	// that will be cloned into the primary cache if the primary cache
 	// does not exist.
 	// Example for PR 1234, which targets the foo branch:
 	//    "pr-1234", "branch-foo", "branch-main"
-	Cache []string `json:"-"`
+	Cache []string `json:"cache"`
 
 	// If true, secrets will be mounted.
-	Trusted bool `json:"-"`
+	Trusted bool `json:"trusted"`
+	// Set if the event is trusted because a maintainer used `bender trust`.
+	TrustedBy *TrustApproval `json:"trusted_by,omitempty"`
+	// Maintainer who let the event's jobs run with a command, which skips
+	// the new contributor approval.
+	ApprovedBy string `json:"approved_by,omitempty"`
 }
 
 type Job struct {
 	*Event
 	ID              string            `json:"id"`
 	Name            string            `json:"name"`
-	Script          string            `json:"-"`
-	Permissions     map[string]string `json:"-"`
-	PermissionRepos []string          `json:"-"`
+	Script          string            `json:"script"`
+	Permissions     map[string]string `json:"permissions"`
+	PermissionRepos []string          `json:"permission_repos"`
+	Concurrency     string            `json:"concurrency"`
+	Timeout         time.Duration     `json:"timeout"`
+	// Container image to run the job in. Empty means the default from the config.
+	Image string `json:"image"`
+	// Path of a Dockerfile in the repo to build the job's image from, instead of using Image.
+	Dockerfile string `json:"dockerfile"`
+	// Limits requested by the job. Zero fields mean the default from the config.
+	Resources Resources `json:"resources"`
+	// Problem matchers for the job's log. Empty means all built-in ones.
+	Matchers []MatcherSpec `json:"matchers"`
+
+	State      JobState   `json:"state"`
+	CreatedAt  time.Time  `json:"created_at"`
+	StartedAt  *time.Time `json:"started_at,omitempty"`
+	FinishedAt *time.Time `json:"finished_at,omitempty"`
+	// Exit code of the job script. nil if it didn't exit (it failed to start, etc).
+	ExitCode *int   `json:"exit_code,omitempty"`
+	Error    string `json:"error,omitempty"`
+	// ID of the job's GitHub check run, 0 if it has none (yet, or `use_statuses` is on).
+	CheckRunID int64 `json:"check_run_id,omitempty"`
+	// Resource usage sampled from the job's cgroup while it ran.
+	Stats *JobStats `json:"stats,omitempty"`
+	// Sections of the log, found when the job finished.
+	Sections []LogSection `json:"sections,omitempty"`
+	// Sections not in Sections, past the limit.
+	SectionsLeftOut int `json:"sections_left_out,omitempty"`
+	// When the log and artifacts were deleted by the retention policy.
+	DeletedAt *time.Time `json:"deleted_at,omitempty"`
+	// Total size of the artifacts kept. 0 if there are none.
+	ArtifactsSize int64 `json:"artifacts_size,omitempty"`
+	// When the artifacts were deleted by the artifacts policy.
+	ArtifactsExpiredAt *time.Time `json:"artifacts_expired_at,omitempty"`
 }
 
 func main() {
@@ -87,16 +241,27 @@ func main() {
 		log.Fatal(err)
 	}
 	config := Config{
-		ListenPort: 8000,
+		ListenPort:        8000,
+		OrphanedJobs:      "error",
+		MaxConcurrentJobs: 4,
+		DefaultJobTimeout: 2 * time.Hour,
+		ImageBuilder:      "gcr.io/kaniko-project/executor:latest",
+		BuiltImagesExpire: 7 * 24 * time.Hour,
 		Cache: CacheConfig{
 			MinFreeSpaceMB: 20 * 1024, // 20gb
 			MaxSizeMB:      40 * 1024, // 40gb
 		},
+		Retention: RetentionConfig{
+			CompressLogs: true,
+		},
 	}
 	err = yaml.Unmarshal(configData, &config)
 	if err != nil {
 		log.Fatal(err)
 	}
+	if config.OrphanedJobs != "error" && config.OrphanedJobs != "requeue" {
+		log.Fatalf("invalid orphaned_jobs '%s', must be 'error' or 'requeue'", config.OrphanedJobs)
+	}
 
 	config.DataDir, err = filepath.Abs(config.DataDir)
 	if err != nil {
@@ -114,20 +279,40 @@ func main() {
 		log.Fatal(err)
 	}
 
+	db, err := openDB(filepath.Join(config.DataDir, "bender.db"))
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	artifacts, err := newArtifactStore(config)
+	if err != nil {
+		log.Fatal(err)
+	}
+
 	cgroup := initCgroup()
 
 	s := Service{
-		config:      config,
-		containerd:  cntd,
-		runningJobs: make(map[string]struct{}),
-		cgroup:      cgroup,
+		config:        config,
+		containerd:    cntd,
+		db:            db,
+		artifacts:     artifacts,
+		runningJobs:   make(map[string]*runningJob),
+		cgroup:        cgroup,
+		imageConfigs:  make(map[string]*ocispec.Image),
+		logIndexQueue: make(chan struct{}, 1),
 	}
 
+	// Before recovering jobs, requeued ones can start right away.
 	if s.config.NetSandbox != nil {
+		s.netSetup()
 		go s.netRun()
 	}
 
+	s.recoverJobs()
+
 	go s.cacheGCRun()
+	go s.logIndexRun()
+	go s.retentionRun()
 
 	s.serverRun()
 }
@@ -0,0 +1,326 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/google/go-github/v52/github"
+	"github.com/sqlbunny/errors"
+)
+
+// GitHub accepts up to 50 annotations per request.
+const maxAnnotations = 50
+
+// Max lines between a message and its location, for multi-line matchers.
+const matcherLocationLines = 3
+
+var ansiEscapeRegexp = regexp.MustCompile("\x1b\\[[0-9;?]*[A-Za-z]")
+
+// MatcherSpec is a problem matcher declared with `## matcher`.
+// Regexp is empty for built-in matchers.
+type MatcherSpec struct {
+	Name   string `json:"name"`
+	Regexp string `json:"regexp,omitempty"`
+}
+
+// problemMatcher finds diagnostics in job logs.
+//
+// Its regexps use named groups: file, line, col, severity and message.
+// file, line and message are required, the others are optional.
+type problemMatcher struct {
+	name   string
+	regexp *regexp.Regexp
+	// For formats like rustc's, where the file and line come in a line after
+	// the message. If set, regexp has the message and this has the location.
+	location *regexp.Regexp
+}
+
+var builtinMatchers = map[string]*problemMatcher{
+	// error[E0308]: mismatched types
+	//   --> src/main.rs:4:18
+	"rustc": {
+		name:     "rustc",
+		regexp:   regexp.MustCompile(`^(?P<severity>error|warning)(?:\[\w+\])?: (?P<message>.+)$`),
+		location: regexp.MustCompile(`^\s*--> (?P<file>[^\s:]+):(?P<line>\d+):(?P<col>\d+)$`),
+	},
+	// src/foo.c:12:5: error: expected ';' before '}' token
+	"gcc": {
+		name:   "gcc",
+		regexp: regexp.MustCompile(`^(?P<file>[^\s:]+):(?P<line>\d+):(?P<col>\d+): (?P<severity>fatal error|error|warning): (?P<message>.+)$`),
+	},
+	// ./main.go:12:2: undefined: foo
+	//     foo_test.go:30: got 1, want 2
+	"go": {
+		name:   "go",
+		regexp: regexp.MustCompile(`^\s*(?P<file>[^\s:]+\.go):(?P<line>\d+)(?::(?P<col>\d+))?: (?P<message>.+)$`),
+	},
+	// file:line[:col]: error: message
+	"generic": {
+		name:   "generic",
+		regexp: regexp.MustCompile(`^(?P<file>[^\s:]+):(?P<line>\d+):(?:(?P<col>\d+):)?\s*(?P<severity>error|warning)[^:]*:\s*(?P<message>.+)$`),
+	},
+}
+
+// resolveMatchers returns the matchers for the given specs. No specs means
+// all built-in matchers, and `none` means no matchers at all.
+func resolveMatchers(specs []MatcherSpec) ([]*problemMatcher, error) {
+	if len(specs) == 0 {
+		var res []*problemMatcher
+		for _, name := range []string{"rustc", "gcc", "go", "generic"} {
+			res = append(res, builtinMatchers[name])
+		}
+		return res, nil
+	}
+
+	var res []*problemMatcher
+	for _, spec := range specs {
+		if spec.Name == "none" {
+			continue
+		}
+
+		if spec.Regexp == "" {
+			m, ok := builtinMatchers[spec.Name]
+			if !ok {
+				return nil, errors.Errorf("unknown matcher '%s'", spec.Name)
+			}
+			res = append(res, m)
+			continue
+		}
+
+		re, err := regexp.Compile(spec.Regexp)
+		if err != nil {
+			return nil, errors.Errorf("invalid regexp for matcher '%s': %w", spec.Name, err)
+		}
+		for _, group := range []string{"file", "line", "message"} {
+			if re.SubexpIndex(group) < 0 {
+				return nil, errors.Errorf("regexp for matcher '%s' has no '%s' group", spec.Name, group)
+			}
+		}
+		res = append(res, &problemMatcher{name: spec.Name, regexp: re})
+	}
+	return res, nil
+}
+
+// problem is a diagnostic found in a job log.
+type problem struct {
+	Path    string
+	Line    int
+	Col     int
+	Level   string // "failure", "warning" or "notice", like check run annotations.
+	Message string
+}
+
+func (m *problemMatcher) setGroups(p *problem, re *regexp.Regexp, match []string) {
+	for i, name := range re.SubexpNames() {
+		value := match[i]
+		if value == "" {
+			continue
+		}
+		switch name {
+		case "file":
+			p.Path = value
+		case "line":
+			p.Line, _ = strconv.Atoi(value)
+		case "col":
+			p.Col, _ = strconv.Atoi(value)
+		case "message":
+			p.Message = value
+		case "severity":
+			switch strings.ToLower(value) {
+			case "error", "fatal error":
+				p.Level = "failure"
+			case "warning":
+				p.Level = "warning"
+			default:
+				p.Level = "notice"
+			}
+		}
+	}
+}
+
+// matchProblems scans a job log with the matchers, and returns the problems found
+// in files in the repo, without duplicates.
+func matchProblems(r io.Reader, matchers []*problemMatcher) ([]*problem, error) {
+	var res []*problem
+	seen := map[string]bool{}
+	add := func(p *problem) {
+		// The repo is cloned into /ci/code, so paths may be prefixed with it.
+		p.Path = strings.TrimPrefix(p.Path, "/ci/code/")
+		p.Path = strings.TrimPrefix(p.Path, "./")
+		if p.Path == "" || p.Line == 0 || strings.HasPrefix(p.Path, "/") {
+			return
+		}
+		key := fmt.Sprintf("%s:%d:%d:%s", p.Path, p.Line, p.Col, p.Message)
+		if seen[key] {
+			return
+		}
+		seen[key] = true
+		res = append(res, p)
+	}
+
+	// Messages of multi-line matchers waiting for their location.
+	pending := map[*problemMatcher]*problem{}
+	pendingLines := map[*problemMatcher]int{}
+
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		line := strings.TrimRight(ansiEscapeRegexp.ReplaceAllString(scanner.Text(), ""), " \r")
+		for _, m := range matchers {
+			if m.location != nil {
+				if p := pending[m]; p != nil {
+					if match := m.location.FindStringSubmatch(line); match != nil {
+						m.setGroups(p, m.location, match)
+						add(p)
+						delete(pending, m)
+						continue
+					}
+					pendingLines[m]++
+					if pendingLines[m] > matcherLocationLines {
+						delete(pending, m)
+					}
+				}
+			}
+
+			match := m.regexp.FindStringSubmatch(line)
+			if match == nil {
+				continue
+			}
+			p := &problem{Level: "failure"}
+			m.setGroups(p, m.regexp, match)
+			if m.location != nil {
+				pending[m] = p
+				pendingLines[m] = 0
+			} else {
+				add(p)
+			}
+		}
+	}
+	return res, scanner.Err()
+}
+
+// jobProblems returns the problems found in the job's log.
+func (s *Service) jobProblems(job *Job) ([]*problem, error) {
+	matchers, err := resolveMatchers(job.Matchers)
+	if err != nil {
+		return nil, err
+	}
+	if len(matchers) == 0 {
+		return nil, nil
+	}
+
+	f, err := openLog(filepath.Join(s.config.DataDir, "logs", job.ID))
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return matchProblems(f, matchers)
+}
+
+// problemAnnotations returns the problems as check run annotations, up to maxAnnotations.
+func problemAnnotations(problems []*problem) []*github.CheckRunAnnotation {
+	var res []*github.CheckRunAnnotation
+	for _, p := range problems {
+		if len(res) == maxAnnotations {
+			break
+		}
+		a := &github.CheckRunAnnotation{
+			Path:            github.String(p.Path),
+			StartLine:       github.Int(p.Line),
+			EndLine:         github.Int(p.Line),
+			AnnotationLevel: github.String(p.Level),
+			Message:         github.String(p.Message),
+		}
+		if p.Col != 0 {
+			a.StartColumn = github.Int(p.Col)
+			a.EndColumn = github.Int(p.Col)
+		}
+		res = append(res, a)
+	}
+	return res
+}
+
+var hunkHeaderRegexp = regexp.MustCompile(`^@@ -\d+(?:,\d+)? \+(\d+)(?:,(\d+))? @@`)
+
+// diffLines returns the lines of the new side of a file that a PR diff patch
+// touches, which are the only lines review comments can go on.
+func diffLines(patch string) map[int]bool {
+	res := map[int]bool{}
+	line := 0
+	for _, l := range strings.Split(patch, "\n") {
+		if m := hunkHeaderRegexp.FindStringSubmatch(l); m != nil {
+			line, _ = strconv.Atoi(m[1])
+			continue
+		}
+		if line == 0 || strings.HasPrefix(l, "-") || strings.HasPrefix(l, `\`) {
+			continue
+		}
+		res[line] = true
+		line++
+	}
+	return res
+}
+
+// postProblemsReview posts the problems on the lines of the job's PR diff as a review.
+// Problems in lines the PR didn't touch are left out, GitHub rejects comments on them.
+func (s *Service) postProblemsReview(ctx context.Context, gh *github.Client, job *Job, problems []*problem) error {
+	if job.PullRequest == nil || len(problems) == 0 {
+		return nil
+	}
+	owner := *job.Repo.Owner.Login
+	repo := *job.Repo.Name
+	number := *job.PullRequest.Number
+
+	files := map[string]map[int]bool{}
+	opts := &github.ListOptions{PerPage: 100}
+	for {
+		page, resp, err := gh.PullRequests.ListFiles(ctx, owner, repo, number, opts)
+		if err != nil {
+			return err
+		}
+		for _, f := range page {
+			files[f.GetFilename()] = diffLines(f.GetPatch())
+		}
+		if resp.NextPage == 0 {
+			break
+		}
+		opts.Page = resp.NextPage
+	}
+
+	var comments []*github.DraftReviewComment
+	for _, p := range problems {
+		if !files[p.Path][p.Line] || len(comments) == maxAnnotations {
+			continue
+		}
+		level := map[string]string{"failure": "error", "warning": "warning", "notice": "note"}[p.Level]
+		comments = append(comments, &github.DraftReviewComment{
+			Path: github.String(p.Path),
+			Line: github.Int(p.Line),
+			Side: github.String("RIGHT"),
+			Body: github.String(fmt.Sprintf("**%s**: %s", level, p.Message)),
+		})
+	}
+	if len(comments) == 0 {
+		return nil
+	}
+	// Keep them in file order, it reads better in the review.
+	sort.SliceStable(comments, func(i, j int) bool {
+		return *comments[i].Path < *comments[j].Path
+	})
+
+	url := fmt.Sprintf("%s/jobs/%s", s.config.ExternalURL, job.ID)
+	_, _, err := gh.PullRequests.CreateReview(ctx, owner, repo, number, &github.PullRequestReviewRequest{
+		CommitID: github.String(job.SHA),
+		Body:     github.String(fmt.Sprintf("`%s` found %d problems in this PR. [Logs](%s)", job.Name, len(comments), url)),
+		Event:    github.String("COMMENT"),
+		Comments: comments,
+	})
+	return err
+}
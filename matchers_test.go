@@ -0,0 +1,80 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestMatchProblems(t *testing.T) {
+	log := strings.Join([]string{
+		"+ make",
+		"/ci/code/src/main.c:12:5: error: expected ';' before '}' token",
+		"src/util.c:3: warning: unused variable 'x' [-Wunused-variable]",
+		"/usr/include/stdio.h:1:1: error: outside the repo",
+		"\x1b[1m./src/main.c:20:1: \x1b[31merror:\x1b[0m implicit declaration",
+		"src/main.c:12:5: error: expected ';' before '}' token",
+		"make: *** [Makefile:2: all] Error 1",
+		"+ cargo build",
+		"\x1b[1m\x1b[33mwarning\x1b[0m: unused variable: `x`",
+		" \x1b[1m\x1b[34m-->\x1b[0m src/lib.rs:2:9",
+		"  |",
+		"error[E0308]: mismatched types",
+		"  --> src/main.rs:4:18",
+		"error: could not compile `foo` due to previous error",
+		"+ go test ./...",
+		"./main.go:12:2: undefined: foo",
+		"    foo_test.go:30: got 1, want 2",
+	}, "\n")
+
+	matchers, err := resolveMatchers(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := matchProblems(strings.NewReader(log), matchers)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []string{
+		"src/main.c:12:5 failure expected ';' before '}' token",
+		"src/util.c:3:0 warning unused variable 'x' [-Wunused-variable]",
+		"src/main.c:20:1 failure implicit declaration",
+		"src/lib.rs:2:9 warning unused variable: `x`",
+		"src/main.rs:4:18 failure mismatched types",
+		"main.go:12:2 failure undefined: foo",
+		"foo_test.go:30:0 failure got 1, want 2",
+	}
+	var gotStrs []string
+	for _, p := range got {
+		gotStrs = append(gotStrs, fmt.Sprintf("%s:%d:%d %s %s", p.Path, p.Line, p.Col, p.Level, p.Message))
+	}
+	if strings.Join(gotStrs, "\n") != strings.Join(want, "\n") {
+		t.Fatalf("got:\n%s\nwant:\n%s", strings.Join(gotStrs, "\n"), strings.Join(want, "\n"))
+	}
+}
+
+func TestDiffLines(t *testing.T) {
+	patch := strings.Join([]string{
+		"@@ -1,3 +1,4 @@",
+		" a",
+		"-b",
+		"+c",
+		"+d",
+		" e",
+		"@@ -10,2 +11,2 @@ func foo() {",
+		" x",
+		"+y",
+		`\ No newline at end of file`,
+	}, "\n")
+
+	got := diffLines(patch)
+	for _, line := range []int{1, 2, 3, 4, 11, 12} {
+		if !got[line] {
+			t.Errorf("line %d not in diff", line)
+		}
+	}
+	if len(got) != 6 {
+		t.Errorf("got %d lines, want 6: %v", len(got), got)
+	}
+}
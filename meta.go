@@ -4,7 +4,9 @@ import (
 	"fmt"
 	"log"
 	"regexp"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/sqlbunny/errors"
 )
@@ -136,6 +138,18 @@ type Meta struct {
 	Events          []MetaEvent
 	Permissions     map[string]string
 	PermissionRepos []string
+	// "cancel" to cancel runs superseded by a newer commit, "keep" to let them finish.
+	Concurrency string
+	// 0 means use the default timeout from the config.
+	Timeout time.Duration
+	// Empty means use the default image from the config.
+	Image string
+	// Path of a Dockerfile in the repo to build the image from. Can't be used with Image.
+	Dockerfile string
+	// Zero fields mean use the default from the config.
+	Resources Resources
+	// Problem matchers to find diagnostics in the log. Empty means all built-in ones.
+	Matchers []MatcherSpec
 }
 
 type MetaEvent struct {
@@ -148,6 +162,7 @@ func parseMeta(content string) (*Meta, error) {
 		Events:          []MetaEvent{},
 		Permissions:     map[string]string{},
 		PermissionRepos: []string{},
+		Concurrency:     "cancel",
 	}
 
 	lineNum := 0
@@ -198,10 +213,109 @@ func parseMeta(content string) (*Meta, error) {
 			}
 
 			res.PermissionRepos = append(res.PermissionRepos, directive.Args[1])
+		case "concurrency":
+			if len(directive.Args) != 2 {
+				return nil, errors.Errorf("line %d: 'concurrency' directive must have exactly one argument", lineNum)
+			}
+			if len(directive.Conditions) != 0 {
+				return nil, errors.Errorf("line %d: 'concurrency' directive cannot have conditions", lineNum)
+			}
+			if directive.Args[1] != "cancel" && directive.Args[1] != "keep" {
+				return nil, errors.Errorf("line %d: 'concurrency' must be 'cancel' or 'keep'", lineNum)
+			}
+
+			res.Concurrency = directive.Args[1]
+		case "timeout":
+			if len(directive.Args) != 2 {
+				return nil, errors.Errorf("line %d: 'timeout' directive must have exactly one argument", lineNum)
+			}
+			if len(directive.Conditions) != 0 {
+				return nil, errors.Errorf("line %d: 'timeout' directive cannot have conditions", lineNum)
+			}
+			timeout, err := time.ParseDuration(directive.Args[1])
+			if err != nil {
+				return nil, errors.Errorf("line %d: invalid timeout: %v", lineNum, err)
+			}
+			if timeout <= 0 {
+				return nil, errors.Errorf("line %d: timeout must be positive", lineNum)
+			}
+
+			res.Timeout = timeout
+		case "image":
+			if len(directive.Args) != 2 {
+				return nil, errors.Errorf("line %d: 'image' directive must have exactly one argument", lineNum)
+			}
+			if len(directive.Conditions) != 0 {
+				return nil, errors.Errorf("line %d: 'image' directive cannot have conditions", lineNum)
+			}
+
+			res.Image = directive.Args[1]
+		case "dockerfile":
+			if len(directive.Args) != 2 {
+				return nil, errors.Errorf("line %d: 'dockerfile' directive must have exactly one argument", lineNum)
+			}
+			if len(directive.Conditions) != 0 {
+				return nil, errors.Errorf("line %d: 'dockerfile' directive cannot have conditions", lineNum)
+			}
+
+			res.Dockerfile = directive.Args[1]
+		case "resources":
+			if len(directive.Args) != 1 {
+				return nil, errors.Errorf("line %d: 'resources' directive only takes key=value arguments", lineNum)
+			}
+
+			for _, c := range directive.Conditions {
+				if c.Op != "=" {
+					return nil, errors.Errorf("line %d: 'resources' directive only takes key=value arguments", lineNum)
+				}
+
+				var err error
+				switch c.Key {
+				case "cpu":
+					res.Resources.CPU, err = strconv.ParseFloat(c.Value, 64)
+					if err == nil && res.Resources.CPU <= 0 {
+						err = errors.New("must be positive")
+					}
+				case "memory":
+					res.Resources.Memory, err = parseByteSize(c.Value)
+				case "pids":
+					res.Resources.Pids, err = strconv.ParseInt(c.Value, 10, 64)
+					if err == nil && res.Resources.Pids <= 0 {
+						err = errors.New("must be positive")
+					}
+				default:
+					return nil, errors.Errorf("line %d: unknown resource '%s'", lineNum, c.Key)
+				}
+				if err != nil {
+					return nil, errors.Errorf("line %d: invalid %s '%s': %v", lineNum, c.Key, c.Value, err)
+				}
+			}
+		case "matcher":
+			if len(directive.Args) != 2 && len(directive.Args) != 3 {
+				return nil, errors.Errorf("line %d: 'matcher' directive must have one or two arguments", lineNum)
+			}
+			if len(directive.Conditions) != 0 {
+				return nil, errors.Errorf("line %d: 'matcher' directive cannot have conditions", lineNum)
+			}
+
+			spec := MatcherSpec{Name: directive.Args[1]}
+			if len(directive.Args) == 3 {
+				spec.Regexp = directive.Args[2]
+			}
+			// Check it now, so mistakes show up when the script is added instead of when it fails.
+			if _, err := resolveMatchers([]MatcherSpec{spec}); err != nil {
+				return nil, errors.Errorf("line %d: %v", lineNum, err)
+			}
+
+			res.Matchers = append(res.Matchers, spec)
 		default:
 			return nil, errors.Errorf("line %d: unknown directive '%s'", lineNum, directive.Args[0])
 		}
 	}
 
+	if res.Image != "" && res.Dockerfile != "" {
+		return nil, errors.Errorf("'image' and 'dockerfile' directives can't be used together")
+	}
+
 	return &res, nil
 }
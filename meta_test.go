@@ -3,6 +3,7 @@ package main
 import (
 	"reflect"
 	"testing"
+	"time"
 )
 
 func TestParseMeta(t *testing.T) {
@@ -34,6 +35,9 @@ on alalalalalaaaaa
 				Conditions: []DirectiveCondition{},
 			},
 		},
+		Permissions:     map[string]string{},
+		PermissionRepos: []string{},
+		Concurrency:     "cancel",
 	}
 
 	got, err := parseMeta(contents)
@@ -45,6 +49,99 @@ on alalalalalaaaaa
 	}
 }
 
+func TestParseMetaDirectives(t *testing.T) {
+	tests := []struct {
+		in      string
+		check   func(m *Meta) bool
+		wantErr bool
+	}{
+		{
+			in:    "## permission contents write\n## permission_repo foo",
+			check: func(m *Meta) bool { return m.Permissions["contents"] == "write" && m.PermissionRepos[0] == "foo" },
+		},
+		{
+			in:    "## concurrency keep",
+			check: func(m *Meta) bool { return m.Concurrency == "keep" },
+		},
+		{
+			in:      "## concurrency whatever",
+			wantErr: true,
+		},
+		{
+			in:    "## timeout 1h30m",
+			check: func(m *Meta) bool { return m.Timeout == 90*time.Minute },
+		},
+		{
+			in:      "## timeout 30",
+			wantErr: true,
+		},
+		{
+			in:    "## image embassy.dev/ci-docs:latest",
+			check: func(m *Meta) bool { return m.Image == "embassy.dev/ci-docs:latest" },
+		},
+		{
+			in:    "## dockerfile .github/ci/Dockerfile",
+			check: func(m *Meta) bool { return m.Dockerfile == ".github/ci/Dockerfile" },
+		},
+		{
+			in:      "## image foo\n## dockerfile .github/ci/Dockerfile",
+			wantErr: true,
+		},
+		{
+			in: "## resources cpu=4 memory=8G pids=2048",
+			check: func(m *Meta) bool {
+				return m.Resources == Resources{CPU: 4, Memory: 8 << 30, Pids: 2048}
+			},
+		},
+		{
+			in:    "## resources memory=512M",
+			check: func(m *Meta) bool { return m.Resources == Resources{Memory: 512 << 20} },
+		},
+		{
+			in:      "## resources memory=lots",
+			wantErr: true,
+		},
+		{
+			in:      "## resources gpu=1",
+			wantErr: true,
+		},
+		{
+			in: "## matcher rustc\n## matcher lint \"^(?P<file>[^:]+):(?P<line>\\\\d+): (?P<message>.*)$\"",
+			check: func(m *Meta) bool {
+				return reflect.DeepEqual(m.Matchers, []MatcherSpec{
+					{Name: "rustc"},
+					{Name: "lint", Regexp: `^(?P<file>[^:]+):(?P<line>\d+): (?P<message>.*)$`},
+				})
+			},
+		},
+		{
+			in:      "## matcher fortran",
+			wantErr: true,
+		},
+		{
+			in:      "## matcher lint \"^(?P<file>[^:]+): (?P<message>.*)$\"",
+			wantErr: true,
+		},
+	}
+
+	for _, test := range tests {
+		got, err := parseMeta(test.in)
+		if test.wantErr {
+			if err == nil {
+				t.Fatalf("%q: expected error, got nil", test.in)
+			}
+			continue
+		}
+
+		if err != nil {
+			t.Fatalf("%q: %v", test.in, err)
+		}
+		if !test.check(got) {
+			t.Fatalf("%q: unexpected result %+v", test.in, got)
+		}
+	}
+}
+
 func TestParseDirective(t *testing.T) {
 	tests := []struct {
 		in      string
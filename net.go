@@ -91,11 +91,15 @@ func (s *Service) handleDNSRequest(w dns.ResponseWriter, r *dns.Msg) {
 	w.WriteMsg(m)
 }
 
-func (s *Service) netRun() {
+// netSetup sets up the network sandbox. Jobs mustn't start before it's done.
+func (s *Service) netSetup() {
 	os.WriteFile(filepath.Join(s.config.DataDir, "resolv.conf"), []byte("nameserver 127.0.0.93"), 0644)
 
 	s.setupNftables()
+}
 
+// netRun runs the network sandbox's DNS server.
+func (s *Service) netRun() {
 	// attach request handler func
 	dns.HandleFunc(".", s.handleDNSRequest)
 
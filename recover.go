@@ -0,0 +1,176 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/containerd/containerd"
+	"github.com/containerd/containerd/namespaces"
+	"github.com/containerd/containerd/snapshots"
+)
+
+// recoverJobs cleans up leftovers from jobs that were running when bender
+// was stopped or crashed, reports them as failed, and requeues them if the
+// `orphaned_jobs` config option says so.
+//
+// It must run before any new job is started.
+func (s *Service) recoverJobs() {
+	ctx := namespaces.WithNamespace(context.Background(), "bender")
+
+	s.cleanupContainers(ctx)
+	s.cleanupJobDirs()
+	s.cleanupCgroups()
+
+	jobs, err := s.db.listJobs(func(j *Job) bool {
+		return !j.State.finished() && j.State != JobAwaitingApproval
+	}, 0)
+	if err != nil {
+		log.Printf("failed to list orphaned jobs: %v", err)
+		return
+	}
+
+	for _, job := range jobs {
+		log.Printf("found orphaned job %s (%s %s @ %s), was %s", job.ID, *job.Repo.FullName, job.Name, job.SHA, job.State)
+
+		if f, err := os.OpenFile(filepath.Join(s.config.DataDir, "logs", job.ID), os.O_APPEND|os.O_WRONLY, 0); err == nil {
+			fmt.Fprintf(f, "run failed: %v\n", errInterrupted)
+			f.Close()
+		}
+
+		s.finishJob(job, errInterrupted)
+
+		gh, err := s.githubClient(job.InstallationID)
+		if err != nil {
+			log.Printf("error creating github client: %v", err)
+			continue
+		}
+
+		err = s.reportJob(ctx, gh, job, errInterrupted)
+		if err != nil {
+			log.Printf("error reporting interrupted job: %v", err)
+		}
+
+		if s.config.OrphanedJobs == "requeue" {
+			newJob := s.rerunJob(job)
+			log.Printf("requeueing orphaned job %s as %s", job.ID, newJob.ID)
+			s.enqueueJob(ctx, gh, newJob)
+		}
+	}
+}
+
+func (s *Service) cleanupContainers(ctx context.Context) {
+	containers, err := s.containerd.Containers(ctx)
+	if err != nil {
+		log.Printf("failed to list containers: %v", err)
+		return
+	}
+
+	for _, container := range containers {
+		if !strings.HasPrefix(container.ID(), "job-") {
+			continue
+		}
+
+		log.Printf("deleting leftover container %s", container.ID())
+		if task, err := container.Task(ctx, nil); err == nil {
+			task.Kill(ctx, syscall.SIGKILL)
+			_, err = task.Delete(ctx, containerd.WithProcessKill)
+			if err != nil {
+				log.Printf("failed to delete task: %v", err)
+			}
+		}
+		err := container.Delete(ctx, containerd.WithSnapshotCleanup)
+		if err != nil {
+			log.Printf("failed to delete container: %v", err)
+		}
+	}
+
+	// Snapshots can outlive their container if we crashed between creating
+	// the snapshot and the container, or if the container was deleted without cleanup.
+	snapshotter := s.containerd.SnapshotService(containerd.DefaultSnapshotter)
+	var leftover []string
+	err = snapshotter.Walk(ctx, func(ctx context.Context, info snapshots.Info) error {
+		if strings.HasPrefix(info.Name, "job-") {
+			leftover = append(leftover, info.Name)
+		}
+		return nil
+	})
+	if err != nil {
+		log.Printf("failed to list snapshots: %v", err)
+		return
+	}
+	for _, name := range leftover {
+		log.Printf("deleting leftover snapshot %s", name)
+		err := snapshotter.Remove(ctx, name)
+		if err != nil {
+			log.Printf("failed to delete snapshot: %v", err)
+		}
+	}
+}
+
+func (s *Service) cleanupJobDirs() {
+	jobsDir := filepath.Join(s.config.DataDir, "jobs")
+	entries, err := os.ReadDir(jobsDir)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Printf("failed to list job dirs: %v", err)
+		}
+		return
+	}
+
+	for _, e := range entries {
+		jobDir := filepath.Join(jobsDir, e.Name())
+		log.Printf("deleting leftover job dir: %s", jobDir)
+
+		jobCacheDir := filepath.Join(jobDir, "cache")
+		if _, err := os.Stat(jobCacheDir); err == nil {
+			err := doExec("btrfs", "subvolume", "delete", jobCacheDir)
+			if err != nil {
+				log.Printf("error deleting cache: %v", err)
+			}
+		}
+
+		err := os.RemoveAll(jobDir)
+		if err != nil {
+			log.Printf("error deleting job dir: %v", err)
+		}
+	}
+}
+
+func (s *Service) cleanupCgroups() {
+	jobsCgroup := filepath.Join(s.cgroup.mountpoint, s.cgroup.jobs)
+	entries, err := os.ReadDir(jobsCgroup)
+	if err != nil {
+		log.Printf("failed to list job cgroups: %v", err)
+		return
+	}
+
+	for _, e := range entries {
+		if !e.IsDir() || !strings.HasPrefix(e.Name(), "job-") {
+			continue
+		}
+
+		cgroup := filepath.Join(jobsCgroup, e.Name())
+		log.Printf("deleting leftover cgroup: %s", cgroup)
+
+		// cgroup.kill needs Linux 5.14+. If it's not there, the rmdir
+		// below fails if there are still processes in it.
+		os.WriteFile(filepath.Join(cgroup, "cgroup.kill"), []byte("1"), 0)
+		var err error
+		for i := 0; i < 10; i++ {
+			err = os.Remove(cgroup)
+			if err == nil {
+				break
+			}
+			time.Sleep(100 * time.Millisecond)
+		}
+		if err != nil {
+			log.Printf("failed to delete cgroup: %v", err)
+		}
+	}
+}
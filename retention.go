@@ -0,0 +1,203 @@
+package main
+
+import (
+	"compress/gzip"
+	"context"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+func (s *Service) retentionRun() {
+	for {
+		s.applyRetention()
+		s.expireArtifacts()
+		time.Sleep(10 * time.Minute)
+	}
+}
+
+// retentionPolicy returns the retention policy for a repo.
+func (s *Service) retentionPolicy(repo string) RetentionPolicy {
+	if p, ok := s.config.Retention.Repos[repo]; ok {
+		return p
+	}
+	return s.config.Retention.RetentionPolicy
+}
+
+// retainedJob is a finished job whose log and artifacts aren't deleted, in
+// the retained_jobs index.
+type retainedJob struct {
+	ID         string    `json:"-"`
+	FinishedAt time.Time `json:"-"`
+	Repo       string    `json:"repo"`
+	State      JobState  `json:"state"`
+	// Set once applyRetention compressed the log.
+	LogCompressed bool `json:"log_compressed,omitempty"`
+}
+
+// applyRetention deletes the logs and artifacts of the finished jobs that are
+// older than their repo's retention policy allows, and compresses the logs
+// of the rest.
+func (s *Service) applyRetention() {
+	jobs, err := s.db.listRetainedJobs()
+	if err != nil {
+		log.Printf("failed to list jobs for retention: %v", err)
+		return
+	}
+
+	for _, r := range jobs {
+		policy := s.retentionPolicy(r.Repo)
+		// Cancelled jobs didn't fail, they're kept like successful ones.
+		keep := policy.Success
+		if r.State == JobFailure {
+			keep = policy.Failure
+		}
+
+		if keep != 0 && time.Since(r.FinishedAt) > keep {
+			job, err := s.db.getJob(r.ID)
+			if err != nil || job == nil {
+				log.Printf("failed to get job %s for retention: %v", r.ID, err)
+				continue
+			}
+			log.Printf("deleting log and artifacts of job %s, finished at %v", job.ID, r.FinishedAt)
+			if err := s.deleteJobData(job); err != nil {
+				log.Printf("failed to delete data of job %s: %v", job.ID, err)
+			}
+			continue
+		}
+
+		if s.config.Retention.CompressLogs && !r.LogCompressed {
+			err := compressLog(filepath.Join(s.config.DataDir, "logs", r.ID))
+			if err != nil {
+				log.Printf("failed to compress log of job %s: %v", r.ID, err)
+				continue
+			}
+			if err := s.db.setLogCompressed(r); err != nil {
+				log.Printf("failed to save that the log of job %s is compressed: %v", r.ID, err)
+			}
+		}
+	}
+}
+
+// deleteJobData deletes a job's log and artifacts. The job itself stays in the db.
+func (s *Service) deleteJobData(job *Job) error {
+	if err := s.db.unindexJobLog(job.ID); err != nil {
+		return err
+	}
+
+	logPath := filepath.Join(s.config.DataDir, "logs", job.ID)
+	for _, path := range []string{logPath, logPath + ".gz", logPath + ".times"} {
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	if err := s.artifacts.Delete(context.Background(), job.ID); err != nil {
+		return err
+	}
+
+	now := time.Now()
+	job.DeletedAt = &now
+	return s.db.saveJob(job)
+}
+
+// compressLog replaces a log file with a gzipped one, with a `.gz` suffix.
+// It does nothing if the log is already compressed.
+func compressLog(path string) error {
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	stat, err := f.Stat()
+	if err != nil {
+		return err
+	}
+
+	tmp := path + ".gz.tmp"
+	out, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp)
+	defer out.Close()
+
+	w := gzip.NewWriter(out)
+	if _, err := io.Copy(w, f); err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	if err := out.Close(); err != nil {
+		return err
+	}
+	// Keep it, it's the log's Last-Modified.
+	if err := os.Chtimes(tmp, stat.ModTime(), stat.ModTime()); err != nil {
+		return err
+	}
+
+	// Readers open the uncompressed log first, so there's always one of them.
+	if err := os.Rename(tmp, path+".gz"); err != nil {
+		return err
+	}
+	return os.Remove(path)
+}
+
+type gzipLog struct {
+	*gzip.Reader
+	f *os.File
+}
+
+func (l *gzipLog) Close() error {
+	l.Reader.Close()
+	return l.f.Close()
+}
+
+// openLog opens a job's log, decompressing it if it's compressed.
+func openLog(path string) (io.ReadCloser, error) {
+	f, err := os.Open(path)
+	if err == nil {
+		return f, nil
+	} else if !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	f, err = os.Open(path + ".gz")
+	if err != nil {
+		return nil, err
+	}
+	r, err := gzip.NewReader(f)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return &gzipLog{Reader: r, f: f}, nil
+}
+
+// openLogAt opens a job's log like openLog, and skips to offset.
+func openLogAt(path string, offset int64) (io.ReadCloser, error) {
+	r, err := openLog(path)
+	if err != nil {
+		return nil, err
+	}
+
+	if f, ok := r.(*os.File); ok {
+		_, err = f.Seek(offset, io.SeekStart)
+	} else {
+		_, err = io.CopyN(io.Discard, r, offset)
+		if err == io.EOF {
+			// Like seeking past the end.
+			err = nil
+		}
+	}
+	if err != nil {
+		r.Close()
+		return nil, err
+	}
+	return r, nil
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/google/go-github/v52/github"
+)
+
+func TestCompressLog(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "log")
+	if err := os.WriteFile(path, []byte("hello\nworld\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := compressLog(path); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("uncompressed log still exists: %v", err)
+	}
+
+	f, err := openLogAt(path, 6)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	data, err := io.ReadAll(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "world\n" {
+		t.Errorf("got %q, want %q", data, "world\n")
+	}
+}
+
+func TestApplyRetention(t *testing.T) {
+	dir := t.TempDir()
+	db, err := openDB(filepath.Join(dir, "db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.db.Close()
+	for _, d := range []string{"logs", "artifacts"} {
+		if err := os.MkdirAll(filepath.Join(dir, d), 0700); err != nil {
+			t.Fatal(err)
+		}
+	}
+	store, err := newFSArtifactStore(filepath.Join(dir, "artifacts"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &Service{db: db, artifacts: store, config: Config{
+		DataDir: dir,
+		Retention: RetentionConfig{
+			CompressLogs:    true,
+			RetentionPolicy: RetentionPolicy{Success: 24 * time.Hour, Failure: 72 * time.Hour},
+		},
+	}}
+
+	for _, id := range []string{"oldsuccess", "oldfailure", "oldcancelled", "newsuccess"} {
+		finishedAt := time.Now().Add(-48 * time.Hour)
+		state := JobSuccess
+		if id == "oldfailure" {
+			state = JobFailure
+		} else if id == "oldcancelled" {
+			state = JobCancelled
+		} else if id == "newsuccess" {
+			finishedAt = time.Now()
+		}
+		job := &Job{
+			Event:      &Event{Repo: &github.Repository{FullName: github.String("foo/bar")}},
+			ID:         id,
+			State:      state,
+			CreatedAt:  finishedAt,
+			FinishedAt: &finishedAt,
+		}
+		if err := db.saveJob(job); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filepath.Join(dir, "logs", id), []byte("log\n"), 0600); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.MkdirAll(filepath.Join(dir, "artifacts", id), 0700); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	s.applyRetention()
+
+	for id, kept := range map[string]bool{"oldsuccess": false, "oldfailure": true, "oldcancelled": false, "newsuccess": true} {
+		job, err := db.getJob(id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if (job.DeletedAt == nil) != kept {
+			t.Errorf("job %s: got deleted_at %v, want kept %v", id, job.DeletedAt, kept)
+		}
+		_, logErr := os.Stat(filepath.Join(dir, "logs", id+".gz"))
+		_, artifactsErr := os.Stat(filepath.Join(dir, "artifacts", id))
+		if (logErr == nil) != kept || (artifactsErr == nil) != kept {
+			t.Errorf("job %s: got log error %v, artifacts error %v, want kept %v", id, logErr, artifactsErr, kept)
+		}
+	}
+
+	retained, err := db.listRetainedJobs()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(retained) != 2 || retained[0].ID != "oldfailure" || retained[1].ID != "newsuccess" {
+		t.Fatalf("got retained jobs %+v, want oldfailure and newsuccess", retained)
+	}
+	for _, r := range retained {
+		if !r.LogCompressed {
+			t.Errorf("job %s: log not marked compressed", r.ID)
+		}
+	}
+}
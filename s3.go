@@ -0,0 +1,383 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/sqlbunny/errors"
+)
+
+// s3ArtifactStore keeps artifacts in an S3-compatible bucket, each file in an
+// object under "<prefix><jobID>/", and the list of files with their hashes in
+// "<prefix><jobID>.json". Files are served by redirecting to presigned URLs.
+type s3ArtifactStore struct {
+	config   S3ArtifactConfig
+	endpoint *url.URL
+	client   *http.Client
+}
+
+// Presigned URLs can't last longer.
+const s3MaxURLExpiry = 7 * 24 * time.Hour
+
+// The hash of an empty payload.
+const s3EmptySHA256 = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+
+func newS3ArtifactStore(config S3ArtifactConfig) (*s3ArtifactStore, error) {
+	if config.Endpoint == "" || config.Bucket == "" {
+		return nil, errors.New("s3 artifacts store needs endpoint and bucket")
+	}
+	endpoint, err := url.Parse(config.Endpoint)
+	if err != nil {
+		return nil, errors.Errorf("invalid s3 endpoint '%s': %w", config.Endpoint, err)
+	}
+	if endpoint.Scheme != "http" && endpoint.Scheme != "https" {
+		return nil, errors.Errorf("invalid s3 endpoint '%s', must be an http or https URL", config.Endpoint)
+	}
+	if config.Region == "" {
+		config.Region = "us-east-1"
+	}
+	if config.URLExpiry == 0 {
+		config.URLExpiry = time.Hour
+	}
+	if config.URLExpiry > s3MaxURLExpiry {
+		return nil, errors.Errorf("s3 url_expiry %v is longer than the maximum, %v", config.URLExpiry, s3MaxURLExpiry)
+	}
+	// No overall timeout, uploads of big artifacts can take long. Callers
+	// bound them with their context, this catches endpoints that hang.
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.ResponseHeaderTimeout = time.Minute
+	return &s3ArtifactStore{
+		config:   config,
+		endpoint: endpoint,
+		client:   &http.Client{Transport: transport},
+	}, nil
+}
+
+func (st *s3ArtifactStore) fileKey(jobID string, file string) string {
+	return st.config.Prefix + jobID + "/" + file
+}
+
+func (st *s3ArtifactStore) listKey(jobID string) string {
+	return st.config.Prefix + jobID + ".json"
+}
+
+// objectURL returns the URL of an object.
+func (st *s3ArtifactStore) objectURL(key string) *url.URL {
+	u := *st.endpoint
+	p := strings.TrimSuffix(u.Path, "/")
+	if st.config.PathStyle {
+		p += "/" + st.config.Bucket
+	} else {
+		u.Host = st.config.Bucket + "." + u.Host
+	}
+	p += "/" + key
+	u.Path = p
+	u.RawPath = s3Escape(p, false)
+	return &u
+}
+
+// bucketURL returns the URL of the bucket.
+func (st *s3ArtifactStore) bucketURL() *url.URL {
+	u := st.objectURL("")
+	if st.config.PathStyle {
+		u.Path = strings.TrimSuffix(u.Path, "/")
+		u.RawPath = strings.TrimSuffix(u.RawPath, "/")
+	}
+	return u
+}
+
+// s3Escape escapes a string like AWS signatures need: everything but letters,
+// digits and "-._~", and slashes if escapeSlash.
+func s3Escape(s string, escapeSlash bool) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if 'A' <= c && c <= 'Z' || 'a' <= c && c <= 'z' || '0' <= c && c <= '9' ||
+			c == '-' || c == '.' || c == '_' || c == '~' || c == '/' && !escapeSlash {
+			b.WriteByte(c)
+		} else {
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+// s3Query encodes query parameters like AWS signatures need: sorted, and
+// escaped with s3Escape.
+func s3Query(q url.Values) string {
+	keys := make([]string, 0, len(q))
+	for k := range q {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	var parts []string
+	for _, k := range keys {
+		values := append([]string(nil), q[k]...)
+		sort.Strings(values)
+		for _, v := range values {
+			parts = append(parts, s3Escape(k, true)+"="+s3Escape(v, true))
+		}
+	}
+	return strings.Join(parts, "&")
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+// signature returns the AWS Signature Version 4 of a canonical request.
+func (st *s3ArtifactStore) signature(canonicalRequest string, now time.Time) string {
+	hash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := "AWS4-HMAC-SHA256\n" + now.Format("20060102T150405Z") + "\n" + st.scope(now) + "\n" + hex.EncodeToString(hash[:])
+
+	key := hmacSHA256([]byte("AWS4"+st.config.SecretAccessKey), now.Format("20060102"))
+	key = hmacSHA256(key, st.config.Region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	return hex.EncodeToString(hmacSHA256(key, stringToSign))
+}
+
+func (st *s3ArtifactStore) scope(now time.Time) string {
+	return now.Format("20060102") + "/" + st.config.Region + "/s3/aws4_request"
+}
+
+// sign signs a request in its headers. payloadHash is the hex SHA-256 of its body.
+func (st *s3ArtifactStore) sign(req *http.Request, payloadHash string, now time.Time) {
+	now = now.UTC()
+	date := now.Format("20060102T150405Z")
+	req.Header.Set("X-Amz-Date", date)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+
+	signedHeaders := "host;x-amz-content-sha256;x-amz-date"
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		s3Query(req.URL.Query()),
+		"host:" + req.URL.Host,
+		"x-amz-content-sha256:" + payloadHash,
+		"x-amz-date:" + date,
+		"",
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		st.config.AccessKeyID, st.scope(now), signedHeaders, st.signature(canonicalRequest, now)))
+}
+
+// presign returns a URL that can be used to GET an object without credentials
+// until it expires.
+func (st *s3ArtifactStore) presign(key string, expires time.Duration, now time.Time) string {
+	now = now.UTC()
+	u := st.objectURL(key)
+	q := url.Values{
+		"X-Amz-Algorithm":     {"AWS4-HMAC-SHA256"},
+		"X-Amz-Credential":    {st.config.AccessKeyID + "/" + st.scope(now)},
+		"X-Amz-Date":          {now.Format("20060102T150405Z")},
+		"X-Amz-Expires":       {fmt.Sprint(int64(expires / time.Second))},
+		"X-Amz-SignedHeaders": {"host"},
+	}
+	canonicalRequest := strings.Join([]string{
+		"GET",
+		u.EscapedPath(),
+		s3Query(q),
+		"host:" + u.Host,
+		"",
+		"host",
+		"UNSIGNED-PAYLOAD",
+	}, "\n")
+	q.Set("X-Amz-Signature", st.signature(canonicalRequest, now))
+	u.RawQuery = s3Query(q)
+	return u.String()
+}
+
+// do sends a signed request for an object, and returns the response if it's
+// successful. A missing object is an os.ErrNotExist error.
+func (st *s3ArtifactStore) do(ctx context.Context, method string, key string, body io.Reader, size int64, payloadHash string, contentType string) (*http.Response, error) {
+	return st.send(ctx, method, st.objectURL(key), key, body, size, payloadHash, contentType)
+}
+
+// send sends a signed request to u, like do. name is what the request is
+// for, in errors.
+func (st *s3ArtifactStore) send(ctx context.Context, method string, u *url.URL, name string, body io.Reader, size int64, payloadHash string, contentType string) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, method, u.String(), body)
+	if err != nil {
+		return nil, err
+	}
+	if size == 0 {
+		// Otherwise it's sent chunked, which S3 doesn't take.
+		req.Body = http.NoBody
+	}
+	req.ContentLength = size
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	st.sign(req, payloadHash, time.Now())
+
+	res, err := st.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if res.StatusCode/100 == 2 {
+		return res, nil
+	}
+
+	defer res.Body.Close()
+	msg, _ := io.ReadAll(io.LimitReader(res.Body, 1024))
+	if res.StatusCode == 404 {
+		return nil, errors.Errorf("s3 %s %s: %w", method, name, os.ErrNotExist)
+	}
+	return nil, errors.Errorf("s3 %s %s: %s: %s", method, name, res.Status, msg)
+}
+
+func (st *s3ArtifactStore) Put(ctx context.Context, jobID string, dir string) error {
+	files, err := listArtifactFiles(dir)
+	if err != nil {
+		return err
+	}
+	for _, file := range files {
+		if err := st.putFile(ctx, jobID, dir, file); err != nil {
+			return err
+		}
+	}
+
+	// Last, so artifacts are only listed when they're all uploaded.
+	list, err := json.Marshal(files)
+	if err != nil {
+		return err
+	}
+	hash := sha256.Sum256(list)
+	res, err := st.do(ctx, "PUT", st.listKey(jobID), bytes.NewReader(list), int64(len(list)), hex.EncodeToString(hash[:]), "application/json")
+	if err != nil {
+		return err
+	}
+	res.Body.Close()
+
+	if err := os.RemoveAll(dir); err != nil {
+		log.Printf("failed to delete uploaded artifacts in %s: %v", dir, err)
+	}
+	return nil
+}
+
+func (st *s3ArtifactStore) putFile(ctx context.Context, jobID string, dir string, file ArtifactFile) error {
+	f, err := os.Open(filepath.Join(dir, filepath.FromSlash(file.Path)))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	contentType := mime.TypeByExtension(path.Ext(file.Path))
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+	res, err := st.do(ctx, "PUT", st.fileKey(jobID, file.Path), f, file.Size, file.SHA256, contentType)
+	if err != nil {
+		return err
+	}
+	return res.Body.Close()
+}
+
+func (st *s3ArtifactStore) List(ctx context.Context, jobID string) ([]ArtifactFile, error) {
+	res, err := st.do(ctx, "GET", st.listKey(jobID), nil, 0, s3EmptySHA256, "")
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	var files []ArtifactFile
+	if err := json.NewDecoder(res.Body).Decode(&files); err != nil {
+		return nil, errors.Errorf("invalid artifacts list of job %s: %w", jobID, err)
+	}
+	return files, nil
+}
+
+func (st *s3ArtifactStore) Open(ctx context.Context, jobID string, file ArtifactFile) (io.ReadCloser, error) {
+	res, err := st.do(ctx, "GET", st.fileKey(jobID, file.Path), nil, 0, s3EmptySHA256, "")
+	if err != nil {
+		return nil, err
+	}
+	return res.Body, nil
+}
+
+func (st *s3ArtifactStore) ServeFile(w http.ResponseWriter, r *http.Request, jobID string, file ArtifactFile) {
+	http.Redirect(w, r, st.presign(st.fileKey(jobID, file.Path), st.config.URLExpiry, time.Now()), http.StatusFound)
+}
+
+// listKeys returns the keys of the objects that start with prefix.
+func (st *s3ArtifactStore) listKeys(ctx context.Context, prefix string) ([]string, error) {
+	var keys []string
+	token := ""
+	for {
+		u := st.bucketURL()
+		q := url.Values{"list-type": {"2"}, "prefix": {prefix}}
+		if token != "" {
+			q.Set("continuation-token", token)
+		}
+		u.RawQuery = s3Query(q)
+		res, err := st.send(ctx, "GET", u, prefix+"*", nil, 0, s3EmptySHA256, "")
+		if err != nil {
+			return nil, err
+		}
+		var out struct {
+			Contents []struct {
+				Key string
+			}
+			IsTruncated           bool
+			NextContinuationToken string
+		}
+		err = xml.NewDecoder(res.Body).Decode(&out)
+		res.Body.Close()
+		if err != nil {
+			return nil, errors.Errorf("invalid s3 object list of %s: %w", prefix, err)
+		}
+		for _, c := range out.Contents {
+			keys = append(keys, c.Key)
+		}
+		if !out.IsTruncated || out.NextContinuationToken == "" {
+			return keys, nil
+		}
+		token = out.NextContinuationToken
+	}
+}
+
+func (st *s3ArtifactStore) Delete(ctx context.Context, jobID string) error {
+	// Listed in the bucket, not from the artifacts list: it doesn't exist
+	// yet if Put failed partway.
+	keys, err := st.listKeys(ctx, st.fileKey(jobID, ""))
+	if err != nil {
+		return err
+	}
+	// Last, like Put uploads it.
+	keys = append(keys, st.listKey(jobID))
+	for _, key := range keys {
+		res, err := st.do(ctx, "DELETE", key, nil, 0, s3EmptySHA256, "")
+		if errors.Is(err, os.ErrNotExist) {
+			continue
+		} else if err != nil {
+			return err
+		}
+		res.Body.Close()
+	}
+	return nil
+}
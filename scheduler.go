@@ -0,0 +1,237 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/google/go-github/v52/github"
+)
+
+// jobQueue holds the jobs waiting for a free slot. Each repo has its own FIFO
+// queue, and repos take turns, so a big push to one repo can't starve the others.
+type jobQueue struct {
+	repos map[string][]*Job
+	// repos with queued jobs, in the order they'll get their next turn.
+	order []string
+	// number of jobs currently running.
+	running int
+}
+
+func (q *jobQueue) push(job *Job) {
+	if q.repos == nil {
+		q.repos = map[string][]*Job{}
+	}
+
+	repo := *job.Repo.FullName
+	if len(q.repos[repo]) == 0 {
+		q.order = append(q.order, repo)
+	}
+	q.repos[repo] = append(q.repos[repo], job)
+}
+
+// pop returns the next job to run, or nil if the queue is empty.
+func (q *jobQueue) pop() *Job {
+	if len(q.order) == 0 {
+		return nil
+	}
+
+	repo := q.order[0]
+	q.order = q.order[1:]
+
+	jobs := q.repos[repo]
+	job := jobs[0]
+	if len(jobs) == 1 {
+		delete(q.repos, repo)
+	} else {
+		q.repos[repo] = jobs[1:]
+		q.order = append(q.order, repo)
+	}
+	return job
+}
+
+// remove removes and returns all queued jobs for which filter returns true.
+func (q *jobQueue) remove(filter func(*Job) bool) []*Job {
+	var removed []*Job
+	order := q.order[:0]
+	for _, repo := range q.order {
+		var kept []*Job
+		for _, job := range q.repos[repo] {
+			if filter(job) {
+				removed = append(removed, job)
+			} else {
+				kept = append(kept, job)
+			}
+		}
+
+		if len(kept) == 0 {
+			delete(q.repos, repo)
+		} else {
+			q.repos[repo] = kept
+			order = append(order, repo)
+		}
+	}
+	q.order = order
+	return removed
+}
+
+// position returns how many jobs will start before the given job plus one,
+// or 0 if the job isn't queued.
+func (q *jobQueue) position(id string) int {
+	for r, repo := range q.order {
+		for i, job := range q.repos[repo] {
+			if job.ID != id {
+				continue
+			}
+
+			// The job starts in turn i of its repo. Before it, every repo gets
+			// up to i turns, and repos before it in the order get one more.
+			pos := 1
+			for k, other := range q.order {
+				n := len(q.repos[other])
+				if n > i {
+					n = i
+					if k < r {
+						n++
+					}
+				}
+				pos += n
+			}
+			return pos
+		}
+	}
+	return 0
+}
+
+func (s *Service) queuePosition(id string) int {
+	s.queueMutex.Lock()
+	defer s.queueMutex.Unlock()
+	return s.queue.position(id)
+}
+
+// enqueueJob records the job as queued and runs it when there's a free slot.
+func (s *Service) enqueueJob(ctx context.Context, gh *github.Client, job *Job) {
+	job.State = JobQueued
+	s.updateJob(job)
+
+	// Set the status before queueing, so it can't overwrite the status set
+	// when the job starts.
+	err := s.reportJob(ctx, gh, job, nil)
+	if err != nil {
+		log.Printf("error reporting queued job: %v", err)
+	}
+
+	s.queueMutex.Lock()
+	s.queue.push(job)
+	s.queueMutex.Unlock()
+
+	s.cancelSuperseded(job)
+	s.schedule()
+}
+
+// holdJob records the job as awaiting approval. It's queued when a maintainer
+// approves it with `bender approve`.
+func (s *Service) holdJob(ctx context.Context, gh *github.Client, job *Job) {
+	log.Printf("job %s (%s %s @ %s) is awaiting approval", job.ID, *job.Repo.FullName, job.Name, job.SHA)
+	job.State = JobAwaitingApproval
+	s.updateJob(job)
+
+	err := s.reportJob(ctx, gh, job, nil)
+	if err != nil {
+		log.Printf("error reporting job awaiting approval: %v", err)
+	}
+
+	s.cancelSuperseded(job)
+}
+
+// cancelSuperseded cancels the runs superseded by job, unless its concurrency is "keep".
+func (s *Service) cancelSuperseded(job *Job) {
+	if job.Concurrency == "keep" {
+		return
+	}
+	key := job.concurrencyKey()
+	s.cancelJobs(func(j *Job) bool {
+		return j.Concurrency != "keep" && j.SHA != job.SHA && j.concurrencyKey() == key
+	}, fmt.Sprintf("superseded by %s", job.SHA))
+}
+
+// cancelJobs cancels all queued, running and awaiting approval jobs for which
+// filter returns true. It returns the number of cancelled jobs.
+func (s *Service) cancelJobs(filter func(*Job) bool, reason string) int {
+	ctx, cancel := context.WithTimeout(context.Background(), 60*time.Second)
+	defer cancel()
+
+	s.queueMutex.Lock()
+	queued := s.queue.remove(filter)
+	s.queueMutex.Unlock()
+
+	// Jobs awaiting approval are only in the db, and have no log either.
+	// They're marked as cancelled in the same transaction that finds them,
+	// so they can't be approved meanwhile.
+	awaiting, err := s.db.updateUnfinishedJobs(JobAwaitingApproval, filter, func(j *Job) {
+		j.State = JobCancelled
+	})
+	if err != nil {
+		log.Printf("failed to list jobs awaiting approval: %v", err)
+	}
+	queued = append(queued, awaiting...)
+
+	for _, job := range queued {
+		log.Printf("cancelling queued job %s: %s", job.ID, reason)
+		// Queued jobs have no log yet, leave one so the job page says what happened.
+		os.WriteFile(filepath.Join(s.config.DataDir, "logs", job.ID), []byte(fmt.Sprintf("run cancelled: %s\n", reason)), 0600)
+		cancelErr := &cancelError{reason}
+		s.finishJob(job, cancelErr)
+
+		gh, err := s.githubClient(job.InstallationID)
+		if err != nil {
+			log.Printf("error creating github client: %v", err)
+			continue
+		}
+		err = s.reportJob(ctx, gh, job, cancelErr)
+		if err != nil {
+			log.Printf("error reporting cancelled job: %v", err)
+		}
+	}
+
+	// Running jobs report their own status when they exit.
+	count := len(queued)
+	s.runningJobsMutex.Lock()
+	for _, r := range s.runningJobs {
+		if filter(r.job) {
+			log.Printf("cancelling running job %s: %s", r.job.ID, reason)
+			r.cancel(&cancelError{reason})
+			count++
+		}
+	}
+	s.runningJobsMutex.Unlock()
+
+	return count
+}
+
+// schedule starts queued jobs until the concurrency limit is reached.
+func (s *Service) schedule() {
+	s.queueMutex.Lock()
+	defer s.queueMutex.Unlock()
+
+	for s.config.MaxConcurrentJobs == 0 || s.queue.running < s.config.MaxConcurrentJobs {
+		job := s.queue.pop()
+		if job == nil {
+			return
+		}
+
+		s.queue.running++
+		r := s.addRunningJob(job)
+		go func() {
+			s.runJob(context.Background(), r)
+
+			s.queueMutex.Lock()
+			s.queue.running--
+			s.queueMutex.Unlock()
+			s.schedule()
+		}()
+	}
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/google/go-github/v52/github"
+)
+
+func TestJobQueue(t *testing.T) {
+	a := &github.Repository{FullName: github.String("foo/a")}
+	b := &github.Repository{FullName: github.String("foo/b")}
+
+	var q jobQueue
+	for _, j := range []struct {
+		id   string
+		repo *github.Repository
+	}{
+		{"a1", a},
+		{"a2", a},
+		{"a3", a},
+		{"b1", b},
+		{"b2", b},
+	} {
+		q.push(&Job{ID: j.id, Event: &Event{Repo: j.repo}})
+	}
+
+	want := []string{"a1", "b1", "a2", "b2", "a3"}
+	for i, id := range want {
+		if got := q.position(id); got != i+1 {
+			t.Fatalf("position(%s): got %d, want %d", id, got, i+1)
+		}
+	}
+	if got := q.position("nope"); got != 0 {
+		t.Fatalf("position(nope): got %d, want 0", got)
+	}
+
+	for _, id := range want {
+		job := q.pop()
+		if job == nil || job.ID != id {
+			t.Fatalf("got %v, want %s", job, id)
+		}
+	}
+	if job := q.pop(); job != nil {
+		t.Fatalf("got %v, want nil", job)
+	}
+}
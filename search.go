@@ -0,0 +1,388 @@
+package main
+
+import (
+	"html/template"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/sqlbunny/errors"
+)
+
+// Logs are indexed by their words ("tokens"): runs of letters, digits and
+// underscores, lowercased. Searching finds the jobs whose logs have all the
+// query's words, then finds the query in their logs.
+const (
+	// Shorter tokens aren't indexed, they'd match almost every log.
+	minTokenLen = 3
+	// Longer tokens are truncated.
+	maxTokenLen = 64
+	// Only this many distinct tokens per log are indexed.
+	maxLogTokens = 200000
+
+	// Searches only read the logs of this many of the most recent jobs that
+	// can match, created in the last searchMaxAge.
+	searchMaxScan = 500
+	searchMaxAge  = 31 * 24 * time.Hour
+	// How many lines are shown per job.
+	searchMaxLines = 5
+	// Lines are truncated to this length in results.
+	searchMaxLineLen = 300
+)
+
+// tokenize calls f with each token in s.
+func tokenize(s string, f func(string)) {
+	for _, t := range strings.FieldsFunc(strings.ToLower(s), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r) && r != '_'
+	}) {
+		if len(t) < minTokenLen {
+			continue
+		}
+		if len(t) > maxTokenLen {
+			t = t[:maxTokenLen]
+		}
+		f(t)
+	}
+}
+
+// logTextLines calls f with the text of each line of a log, as shown in the
+// log page, with its number.
+func logTextLines(path string, f func(n int, text string) error) error {
+	file, err := openLog(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	var conv ansiConverter
+	n := 0
+	cur := ""
+	lines := func(s string) error {
+		for s != "" {
+			line, rest, complete := strings.Cut(s, "\n")
+			s = rest
+			cur += htmlText(line)
+			if complete {
+				n++
+				if err := f(n, cur); err != nil {
+					return err
+				}
+				cur = ""
+			}
+		}
+		return nil
+	}
+
+	buf := make([]byte, 32*1024)
+	for {
+		c, err := file.Read(buf)
+		if err := lines(conv.Convert(buf[:c])); err != nil {
+			return err
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+	}
+	if err := lines(conv.Flush()); err != nil {
+		return err
+	}
+	if cur != "" {
+		return f(n+1, cur)
+	}
+	return nil
+}
+
+// indexJobLog adds a finished job's log to the search index.
+func (s *Service) indexJobLog(jobID string) error {
+	tokens := map[string]bool{}
+	capped := false
+	err := logTextLines(filepath.Join(s.config.DataDir, "logs", jobID), func(n int, text string) error {
+		tokenize(text, func(t string) {
+			if len(tokens) < maxLogTokens {
+				tokens[t] = true
+			} else if !tokens[t] && !capped {
+				log.Printf("log of job %s has more than %d distinct words, only indexing the first ones", jobID, maxLogTokens)
+				capped = true
+			}
+		})
+		return nil
+	})
+	if os.IsNotExist(err) {
+		// Nothing to index, but remember it's done.
+		err = nil
+	}
+	if err != nil {
+		return err
+	}
+
+	var list []string
+	for t := range tokens {
+		list = append(list, t)
+	}
+	return s.db.indexJobLog(jobID, list)
+}
+
+// logIndexRun indexes the logs of finished jobs, which wait in
+// log_index_pending, when queueLogIndex says there are new ones.
+func (s *Service) logIndexRun() {
+	// Not retried until the next start.
+	failed := map[string]bool{}
+	for {
+		ids, err := s.db.listPendingLogIndex()
+		if err != nil {
+			log.Printf("failed to list jobs to index: %v", err)
+		}
+		for _, id := range ids {
+			if failed[id] {
+				continue
+			}
+			if err := s.indexJobLog(id); err != nil {
+				log.Printf("failed to index log of job %s: %v", id, err)
+				failed[id] = true
+			}
+		}
+		<-s.logIndexQueue
+	}
+}
+
+// queueLogIndex tells logIndexRun there are jobs to index. Finished jobs are
+// in log_index_pending already, saved with them.
+func (s *Service) queueLogIndex() {
+	select {
+	case s.logIndexQueue <- struct{}{}:
+	default:
+		// It's already been told.
+	}
+}
+
+type searchQuery struct {
+	Query  string
+	Repo   string
+	Job    string
+	Branch string
+	Limit  int
+}
+
+type searchLine struct {
+	Line int    `json:"line"`
+	Text string `json:"text"`
+}
+
+type searchResult struct {
+	Job   *Job         `json:"job"`
+	Lines []searchLine `json:"lines"`
+	// Whether there are more matching lines than in Lines.
+	More bool `json:"more"`
+}
+
+// searchLogs returns the finished jobs whose logs contain the query, ignoring
+// case, newest first. Jobs are found by the words in the query, so it can't
+// start in the middle of a word. Only the logs of the searchMaxScan most recent
+// jobs that have the words are read, from the last searchMaxAge.
+func (s *Service) searchLogs(q searchQuery) ([]*searchResult, error) {
+	query := strings.ToLower(strings.TrimSpace(q.Query))
+	if query == "" {
+		return nil, errors.New("empty query")
+	}
+
+	var words []string
+	tokenize(query, func(t string) {
+		words = append(words, t)
+	})
+	var candidates map[string]bool
+	if len(words) != 0 {
+		var err error
+		candidates, err = s.db.searchLogIndex(words)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	jobs, err := s.db.listJobsSince(time.Now().Add(-searchMaxAge), candidates, func(j *Job) bool {
+		if !j.State.finished() {
+			return false
+		}
+		if q.Repo != "" && *j.Repo.FullName != q.Repo {
+			return false
+		}
+		if q.Job != "" && j.Name != q.Job {
+			return false
+		}
+		if q.Branch != "" && j.Attributes["branch"] != q.Branch {
+			return false
+		}
+		return true
+	}, searchMaxScan)
+	if err != nil {
+		return nil, err
+	}
+
+	var res []*searchResult
+	for _, job := range jobs {
+		r := &searchResult{Job: job}
+		err := logTextLines(filepath.Join(s.config.DataDir, "logs", job.ID), func(n int, text string) error {
+			if !strings.Contains(strings.ToLower(text), query) {
+				return nil
+			}
+			if len(r.Lines) == searchMaxLines {
+				r.More = true
+				return io.EOF
+			}
+			if len(text) > searchMaxLineLen {
+				text = truncateUTF8(text, searchMaxLineLen) + "…"
+			}
+			r.Lines = append(r.Lines, searchLine{Line: n, Text: text})
+			return nil
+		})
+		if err != nil && err != io.EOF && !os.IsNotExist(err) {
+			log.Printf("failed to search log of job %s: %v", job.ID, err)
+		}
+		if len(r.Lines) != 0 {
+			res = append(res, r)
+			if len(res) == q.Limit {
+				break
+			}
+		}
+	}
+	return res, nil
+}
+
+// truncateUTF8 returns the start of s, at most n bytes long, without cutting a
+// character.
+func truncateUTF8(s string, n int) string {
+	if len(s) <= n {
+		return s
+	}
+	for n > 0 && !utf8.RuneStart(s[n]) {
+		n--
+	}
+	return s[:n]
+}
+
+// parseSearchQuery parses the query parameters of the search page and API.
+func parseSearchQuery(r *http.Request) (searchQuery, error) {
+	v := r.URL.Query()
+	q := searchQuery{
+		Query:  v.Get("q"),
+		Repo:   v.Get("repo"),
+		Job:    v.Get("job"),
+		Branch: v.Get("branch"),
+		Limit:  50,
+	}
+	if l := v.Get("limit"); l != "" {
+		n, err := strconv.Atoi(l)
+		if err != nil || n <= 0 || n > 500 {
+			return q, errors.Errorf("invalid limit '%s', must be between 1 and 500", l)
+		}
+		q.Limit = n
+	}
+	return q, nil
+}
+
+var searchTemplate = template.Must(template.New("search").Parse(`<!DOCTYPE html>
+<html>
+	<head>
+		<title>{{if .Query.Query}}{{.Query.Query}} - {{end}}search - bender</title>
+		<style type="text/css">
+			body { font-family: sans-serif; }
+			pre { margin: 0; }
+			.job { margin-top: 1em; }
+			.line a { color: #999; text-decoration: none; display: inline-block; min-width: 4em; }
+		</style>
+	</head>
+	<body>
+		<h1><a href="/">bender</a> / search</h1>
+		<form>
+			<input name="q" value="{{.Query.Query}}" placeholder="text in the log" size="50" autofocus>
+			<input name="repo" value="{{.Query.Repo}}" placeholder="owner/repo">
+			<input name="job" value="{{.Query.Job}}" placeholder="job">
+			<input name="branch" value="{{.Query.Branch}}" placeholder="branch">
+			<button>Search</button>
+		</form>
+		{{if .Error}}<p>{{.Error}}</p>{{end}}
+		{{if .Searched}}
+		{{range .Results}}
+		<div class="job">
+			<div>
+				<a href="/jobs/{{.Job.ID}}">{{.Job.Repo.FullName}} {{.Job.Name}}</a>
+				{{with .Job.PullRequest}}PR #{{.Number}}{{else}}{{index .Job.Attributes "branch"}}{{end}}
+				<code>{{printf "%.8s" .Job.SHA}}</code>
+				{{.Job.State}}, {{.Job.CreatedAt.Local.Format "2006-01-02 15:04"}}
+			</div>
+			{{$id := .Job.ID}}
+			{{range .Lines}}<pre class="line"><a href="/jobs/{{$id}}#L{{.Line}}">{{.Line}}</a>{{.Text}}</pre>{{end}}
+			{{if .More}}<div><a href="/jobs/{{.Job.ID}}">more…</a></div>{{end}}
+		</div>
+		{{else}}
+		<p>No results.</p>
+		{{end}}
+		{{end}}
+	</body>
+</html>
+`))
+
+func (s *Service) HandleSearch(w http.ResponseWriter, r *http.Request) {
+	q, err := parseSearchQuery(r)
+	data := struct {
+		Query    searchQuery
+		Searched bool
+		Results  []*searchResult
+		Error    string
+	}{Query: q}
+	if err != nil {
+		data.Error = err.Error()
+	} else if strings.TrimSpace(q.Query) != "" {
+		data.Searched = true
+		data.Results, err = s.searchLogs(q)
+		if err != nil {
+			log.Printf("failed to search logs: %v", err)
+			data.Error = "Search failed."
+		}
+	}
+
+	w.Header().Add("Content-Type", "text/html; charset=utf-8")
+	if err := searchTemplate.Execute(w, data); err != nil {
+		log.Printf("failed to render search: %v", err)
+	}
+}
+
+type apiSearchResult struct {
+	*searchResult
+	// Replaces the result's Job, it's sent like in the jobs API.
+	Job apiJobResponse `json:"job"`
+}
+
+// HandleAPISearch searches job logs. Query parameters: q (the text to find),
+// repo, job, branch, and limit (default 50, max 500).
+func (s *Service) HandleAPISearch(w http.ResponseWriter, r *http.Request) {
+	q, err := parseSearchQuery(r)
+	if err != nil {
+		apiError(w, 400, "%v", err)
+		return
+	}
+	if strings.TrimSpace(q.Query) == "" {
+		apiError(w, 400, "missing q")
+		return
+	}
+	res, err := s.searchLogs(q)
+	if err != nil {
+		log.Printf("failed to search logs: %v", err)
+		apiError(w, 500, "search failed")
+		return
+	}
+	results := []apiSearchResult{}
+	for _, r := range res {
+		results = append(results, apiSearchResult{searchResult: r, Job: s.apiJobResponse(r.Job)})
+	}
+	apiJSON(w, 200, map[string]any{"results": results})
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/google/go-github/v52/github"
+)
+
+func TestSearchLogs(t *testing.T) {
+	dir := t.TempDir()
+	db, err := openDB(filepath.Join(dir, "db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.db.Close()
+	if err := os.Mkdir(filepath.Join(dir, "logs"), 0700); err != nil {
+		t.Fatal(err)
+	}
+	s := &Service{config: Config{DataDir: dir}, db: db}
+
+	logs := map[string]string{
+		"job1": "+ cargo test\nthread 'main' \x1b[31mpanicked\x1b[0m at 'index out of bounds'\nok\n",
+		"job2": "+ cargo test\nall good\n",
+		"job3": "thread 'foo' panicked at 'index out of bounds'",
+		// Too old to be searched.
+		"old": "thread 'main' panicked at 'index out of bounds'",
+	}
+	now := time.Now()
+	for i, id := range []string{"job1", "job2", "job3", "old"} {
+		job := &Job{
+			Event:     &Event{Repo: &github.Repository{FullName: github.String("foo/bar")}},
+			ID:        id,
+			State:     JobFailure,
+			CreatedAt: now.Add(time.Duration(i-10) * time.Second),
+		}
+		if id == "old" {
+			job.CreatedAt = now.Add(-2 * searchMaxAge)
+		}
+		if id == "job3" {
+			job.Repo = &github.Repository{FullName: github.String("foo/baz")}
+			job.Script = "echo secret"
+			job.Permissions = map[string]string{"contents": "write"}
+			job.PermissionRepos = []string{"foo/baz"}
+		}
+		if err := db.saveJob(job); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filepath.Join(dir, "logs", id), []byte(logs[id]), 0600); err != nil {
+			t.Fatal(err)
+		}
+		if pending, err := db.listPendingLogIndex(); err != nil || len(pending) != 1 || pending[0] != id {
+			t.Fatalf("got pending log index %v, %v, want %s", pending, err, id)
+		}
+		if err := s.indexJobLog(id); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if pending, err := db.listPendingLogIndex(); err != nil || len(pending) != 0 {
+		t.Fatalf("got pending log index %v, %v after indexing", pending, err)
+	}
+
+	res, err := s.searchLogs(searchQuery{Query: "PANICKED at 'index out", Limit: 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(res) != 2 || res[0].Job.ID != "job3" || res[1].Job.ID != "job1" {
+		t.Fatalf("got %d results, want job3 and job1", len(res))
+	}
+	if l := res[1].Lines; len(l) != 1 || l[0].Line != 2 || l[0].Text != "thread 'main' panicked at 'index out of bounds'" {
+		t.Errorf("got lines %+v", l)
+	}
+
+	res, err = s.searchLogs(searchQuery{Query: "panic", Repo: "foo/bar", Limit: 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(res) != 1 || res[0].Job.ID != "job1" {
+		t.Errorf("got %d results, want job1", len(res))
+	}
+
+	if err := db.unindexJobLog("job1"); err != nil {
+		t.Fatal(err)
+	}
+	res, err = s.searchLogs(searchQuery{Query: "panic", Limit: 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(res) != 1 || res[0].Job.ID != "job3" {
+		t.Errorf("got %d results after unindexing job1, want job3", len(res))
+	}
+
+	// The API leaves out the same fields as the jobs API.
+	w := httptest.NewRecorder()
+	s.HandleAPISearch(w, httptest.NewRequest("GET", "/api/v1/search?q=panicked", nil))
+	var body struct {
+		Results []struct {
+			Job map[string]any `json:"job"`
+		} `json:"results"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+		t.Fatal(err)
+	}
+	if len(body.Results) != 1 || body.Results[0].Job["id"] != "job3" {
+		t.Fatalf("got API results %s, want job3", w.Body)
+	}
+	for _, field := range []string{"script", "permissions", "permission_repos"} {
+		if _, ok := body.Results[0].Job[field]; ok {
+			t.Errorf("search API sends the job's %s", field)
+		}
+	}
+}
+
+func TestTruncateUTF8(t *testing.T) {
+	for _, tc := range []struct {
+		s    string
+		n    int
+		want string
+	}{
+		{"abc", 5, "abc"},
+		{"abc", 2, "ab"},
+		{"aé", 2, "a"},
+		{"aé", 3, "aé"},
+		{"a€b", 3, "a"},
+		{"a€b", 4, "a€"},
+	} {
+		if got := truncateUTF8(tc.s, tc.n); got != tc.want {
+			t.Errorf("truncateUTF8(%q, %d) = %q, want %q", tc.s, tc.n, got, tc.want)
+		}
+	}
+}
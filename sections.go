@@ -0,0 +1,103 @@
+package main
+
+import (
+	"html"
+	"io"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// LogSection is a group of log lines, delimited by lines printed by the script
+// with GitHub Actions' syntax: `##[group]Name` or `::group::Name`, and
+// `##[endgroup]` or `::endgroup::`. Groups don't nest, a group start ends the
+// previous group.
+type LogSection struct {
+	Name string `json:"name"`
+	// Log lines, 1-based, including the markers.
+	StartLine int `json:"start_line"`
+	EndLine   int `json:"end_line"`
+	// Since the job started. 0 for logs without times.
+	Start    time.Duration `json:"start"`
+	Duration time.Duration `json:"duration"`
+	// The job failed in this section: it never ended.
+	Failed bool `json:"failed,omitempty"`
+}
+
+// groupMarker returns whether a log line starts a group, with its name,
+// or ends it.
+func groupMarker(line string) (start bool, end bool, name string) {
+	line = strings.TrimSpace(line)
+	for _, prefix := range []string{"##[group]", "::group::"} {
+		if name, ok := strings.CutPrefix(line, prefix); ok {
+			return true, false, strings.TrimSpace(name)
+		}
+	}
+	if line == "##[endgroup]" || line == "::endgroup::" {
+		return false, true, ""
+	}
+	return false, false, ""
+}
+
+// Limits of the sections kept in a job. They come from the job's output, and
+// jobs are decoded every time they're listed.
+const (
+	jobMaxSections = 200
+	// In characters.
+	jobMaxSectionName = 200
+)
+
+var htmlTagRegexp = regexp.MustCompile("<[^>]*>")
+
+// htmlText returns the text of the HTML for a log line.
+func htmlText(s string) string {
+	return html.UnescapeString(htmlTagRegexp.ReplaceAllString(s, ""))
+}
+
+// jobLogSections finds the sections in a job's log. If the job failed and
+// the log ends in a section, that's where it failed. Past jobMaxSections, only
+// the first ones and the last are returned, with how many were left out.
+func (s *Service) jobLogSections(job *Job, failed bool) ([]LogSection, int, error) {
+	logPath := filepath.Join(s.config.DataDir, "logs", job.ID)
+	f, err := openLog(logPath)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer f.Close()
+
+	r := newLogRenderer(logPath, nil)
+	defer r.Close()
+	buf := make([]byte, 32*1024)
+	for {
+		n, err := f.Read(buf)
+		r.Write(buf[:n])
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, 0, err
+		}
+	}
+	r.Flush()
+	r.endSection(failed)
+	sections, leftOut := capSections(r.sections)
+	return sections, leftOut, nil
+}
+
+// capSections limits sections to jobMaxSections, and their names to
+// jobMaxSectionName. It keeps the last section, the job may have failed in it.
+// It returns how many were left out.
+func capSections(sections []LogSection) ([]LogSection, int) {
+	leftOut := 0
+	if len(sections) > jobMaxSections {
+		leftOut = len(sections) - jobMaxSections
+		sections = append(sections[:jobMaxSections-1], sections[len(sections)-1])
+	}
+	for i := range sections {
+		if r := []rune(sections[i].Name); len(r) > jobMaxSectionName {
+			sections[i].Name = string(r[:jobMaxSectionName]) + "…"
+		}
+	}
+	return sections, leftOut
+}
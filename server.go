@@ -8,7 +8,6 @@ import (
 	"io"
 	"log"
 	"net/http"
-	"os"
 	"path/filepath"
 	"regexp"
 	"strings"
@@ -24,9 +23,15 @@ func (s *Service) serverRun() {
 
 	r := chi.NewRouter()
 	r.Use(middleware.Logger)
+	r.Get("/", s.HandleDashboard)
+	r.Get("/repos/{owner}/{repo}", s.HandleDashboard)
+	r.Get("/search", s.HandleSearch)
+	r.Get("/artifacts", s.HandleArtifactsUsage)
 	r.Get("/jobs/{jobID}", s.HandleJobLogs)
+	r.Get("/jobs/{jobID}/events", s.HandleJobLogEvents)
 	r.Get("/jobs/{jobID}/artifacts", http.RedirectHandler("artifacts/", http.StatusMovedPermanently).ServeHTTP)
 	r.Get("/jobs/{jobID}/artifacts/*", s.HandleJobArtifacts)
+	r.Mount("/api/v1", s.apiRoutes())
 	r.Post("/webhook", func(w http.ResponseWriter, r *http.Request) {
 		err := s.handleWebhook(r)
 		if err != nil {
@@ -46,7 +51,7 @@ func validJobID(id string) bool {
 	return err == nil && ok
 }
 
-func (s *Service) HandleJobArtifacts(w http.ResponseWriter, r *http.Request) {
+func (s *Service) HandleJobLogs(w http.ResponseWriter, r *http.Request) {
 	jobID := chi.URLParam(r, "jobID")
 	if !validJobID(jobID) {
 		log.Printf("invalid job ID: '%s'", jobID)
@@ -54,51 +59,123 @@ func (s *Service) HandleJobArtifacts(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// serve files from data/artifacts/<jobID>/
-	http.StripPrefix("/jobs/"+jobID+"/artifacts/", http.FileServer(http.Dir(filepath.Join(s.config.DataDir, "artifacts", jobID)))).ServeHTTP(w, r)
-}
+	// Jobs from before the db existed have logs but no record.
+	job, err := s.db.getJob(jobID)
+	if err != nil {
+		log.Printf("failed to get job: %v", err)
+	}
+	title := "job " + jobID
+	info := ""
+	if job != nil {
+		title = fmt.Sprintf("%s - %s", job.Name, *job.Repo.FullName)
+		info = jobInfo(job)
+	}
 
-func (s *Service) HandleJobLogs(w http.ResponseWriter, r *http.Request) {
-	jobID := chi.URLParam(r, "jobID")
-	if !validJobID(jobID) {
-		log.Printf("invalid job ID: '%s'", jobID)
-		http.Error(w, http.StatusText(404), 404)
+	w.Header().Add("Content-Type", "text/html; charset=utf-8")
+	w.Header().Add("X-Content-Type-Options", "nosniff")
+
+	logPath := filepath.Join(s.config.DataDir, "logs", jobID)
+	f, err := openLog(logPath)
+	if err != nil && job != nil && (job.State == JobQueued || job.State == JobAwaitingApproval) {
+		// The log file is created when the job starts.
+		waiting := fmt.Sprintf("Waiting for a free slot, position %d in queue.", s.queuePosition(jobID))
+		if job.State == JobAwaitingApproval {
+			waiting = fmt.Sprintf("Waiting for a maintainer to approve the run with `bender approve %.7s`.", job.SHA)
+		}
+		fmt.Fprintf(w, `
+	<!DOCTYPE html>
+	<html>
+		<head>
+			<title>%s</title>
+			<meta http-equiv="refresh" content="5">
+		</head>
+		<body>
+			<div id="info">%s</div>
+			<div>%s</div>
+		</body>
+	</html>`, html.EscapeString(title), html.EscapeString(info), html.EscapeString(waiting))
+		return
+	}
+	if err != nil && job != nil && job.DeletedAt != nil {
+		w.WriteHeader(410)
+		fmt.Fprintf(w, `
+	<!DOCTYPE html>
+	<html>
+		<head>
+			<title>%s</title>
+		</head>
+		<body>
+			<div id="info">%s</div>
+			<div>The log was deleted on %s by the retention policy.</div>
+		</body>
+	</html>`, html.EscapeString(title), html.EscapeString(info), job.DeletedAt.UTC().Format("2006-01-02 15:04 UTC"))
 		return
 	}
-
-	f, err := os.Open(filepath.Join(s.config.DataDir, "logs", jobID))
 	if err != nil {
 		log.Printf("failed to open log file: %v", err)
 		http.Error(w, http.StatusText(404), 404)
 		return
 	}
+	defer f.Close()
 
-	w.Header().Add("Content-Type", "text/html; charset=utf-8")
-	w.Header().Add("X-Content-Type-Options", "nosniff")
-
-	buf := make([]byte, 32*1024)
+	// Checked before reading the log, so nothing written after we stop
+	// reading is missed: the rest comes from the event stream.
+	live := s.isJobRunning(jobID) || (job != nil && !job.State.finished())
 
-	if s.isJobRunning(jobID) {
-		// padding to make browsers instantly start rendering the document
-		// as it arrives from the network. Browsers seem to wait until a minimum
-		// of data has been received before rendering anything...
-		for i := range buf {
-			buf[i] = ' '
-		}
-		w.Write(buf)
+	artifactsLink := ""
+	if job != nil && job.hasArtifacts() {
+		artifactsLink = fmt.Sprintf(` <a href="/jobs/%s/artifacts/">Artifacts</a>`, jobID)
 	}
-
-	io.WriteString(w, `
+	refresh := ""
+	if live {
+		refresh = `<noscript><meta http-equiv="refresh" content="5"></noscript>`
+	}
+	fmt.Fprintf(w, `
 	<!DOCTYPE html>
 	<html>
 		<head>
-			<title>lol job</title>
+			<title>%s</title>
+			%s
 			<style type="text/css">
-				#main {
+				#main, #stats {
 					overflow-anchor: none;
 					font-family: monospace;
 					white-space: pre;
 				}
+				#main .l:target {
+					background-color: #fff5b1;
+				}
+				#main .n, #main .t {
+					display: inline-block;
+					padding-right: 1em;
+					color: #999;
+					text-align: right;
+					text-decoration: none;
+					user-select: none;
+				}
+				#main .n {
+					min-width: 4em;
+				}
+				#main .t {
+					display: none;
+					min-width: 6em;
+				}
+				#times:checked ~ #main .t {
+					display: inline-block;
+				}
+				#main summary {
+					cursor: pointer;
+				}
+				#main summary .l {
+					display: inline;
+				}
+				#main .m {
+					display: none;
+				}
+				#main .d {
+					padding-left: 1em;
+					color: #999;
+				}
 				body::after {
 					overflow-anchor: auto;
 					content: "   ";
@@ -108,35 +185,114 @@ func (s *Service) HandleJobLogs(w http.ResponseWriter, r *http.Request) {
 			</style>
 		</head>
 		<body>
-			<div id="main">`)
+			<div id="info">%s</div>
+			<input type="checkbox" id="times"><label for="times">Show times</label>
+			<a href="/api/v1/jobs/%s/log">Raw log</a>%s
+			<script>
+				// Remember whether times are shown.
+				const times = document.getElementById("times")
+				times.checked = localStorage.getItem("bender-times") == "1"
+				times.addEventListener("change", () => localStorage.setItem("bender-times", times.checked ? "1" : ""))
+			</script>
+			<div id="main">`, html.EscapeString(title), refresh, html.EscapeString(info), jobID, artifactsLink)
+
+	var known []LogSection
+	if job != nil {
+		known = job.Sections
+	}
+	var offset int64
+	lines := newLogRenderer(logPath, known)
+	defer lines.Close()
+	buf := make([]byte, 32*1024)
 	for {
 		n, err := f.Read(buf)
-		if err != nil && !errors.Is(err, io.EOF) {
-			log.Printf("failed to read logs: %v", err)
-			http.Error(w, http.StatusText(500), 500)
-			return
-		}
-
-		if n == 0 {
-			if !s.isJobRunning(jobID) {
+		if n > 0 {
+			offset += int64(n)
+			if _, err := io.WriteString(w, lines.Write(buf[:n])); err != nil {
+				log.Printf("failed to send logs: %v", err)
 				return
 			}
-
-			if f, ok := w.(http.Flusher); ok {
-				f.Flush()
-			}
-			time.Sleep(500 * time.Millisecond)
-			continue
 		}
-
-		escaped := html.EscapeString(string(buf[:n]))
-		_, err = io.WriteString(w, escaped)
+		if errors.Is(err, io.EOF) || n == 0 {
+			break
+		}
 		if err != nil {
-			log.Printf("failed to send logs: %v", err)
-			http.Error(w, http.StatusText(500), 500)
+			log.Printf("failed to read logs: %v", err)
 			return
 		}
 	}
+	if live {
+		// The unfinished line is sent by the event stream when it's done.
+		offset -= int64(lines.Buffered())
+	} else {
+		io.WriteString(w, lines.Flush())
+	}
+	io.WriteString(w, lines.unclosed())
+	fmt.Fprintf(w, "</div>\n<div id=\"stats\">%s</div>\n", html.EscapeString(jobStatsText(job)))
+
+	io.WriteString(w, `<script>
+				// Show the durations of the sections that ended.
+				function showDurations(gds) {
+					for (const gd of gds) {
+						const d = document.querySelector("#" + gd.dataset.g + " > summary .d")
+						if (d) {
+							d.textContent = gd.textContent
+						}
+					}
+				}
+				showDurations(document.querySelectorAll(".gd"))
+
+				// Expand the section of the line in the URL.
+				function showTarget() {
+					const target = location.hash && document.getElementById(location.hash.slice(1))
+					if (target && target.closest("details")) {
+						target.closest("details").open = true
+						target.scrollIntoView()
+					}
+				}
+				window.addEventListener("hashchange", showTarget)
+				showTarget()
+			</script>
+`)
+	if live {
+		fmt.Fprintf(w, `<script>
+				// Append the rest of the log as it's written.
+				const main = document.getElementById("main")
+				const events = new EventSource("/jobs/%s/events?offset=%d")
+				events.addEventListener("log", e => {
+					const tmpl = document.createElement("template")
+					tmpl.innerHTML = JSON.parse(e.data)
+					const gds = tmpl.content.querySelectorAll(".gd")
+					for (const el of [...tmpl.content.children]) {
+						if (el.classList.contains("gc")) {
+							// More lines of the last section.
+							main.lastElementChild.append(...el.childNodes)
+						} else {
+							main.append(el)
+						}
+					}
+					showDurations(gds)
+				})
+				events.addEventListener("end", e => {
+					events.close()
+					const end = JSON.parse(e.data)
+					if (end.info) {
+						document.getElementById("info").textContent = end.info
+					}
+					document.getElementById("stats").textContent = end.stats || ""
+					if (end.failed_section) {
+						document.getElementById(end.failed_section).open = true
+					}
+				})
+				events.addEventListener("error", e => {
+					if (e.data) {
+						events.close()
+					}
+				})
+			</script>
+`, jobID, offset)
+	}
+	io.WriteString(w, "\t\t</body>\n\t</html>\n")
 }
 
 func (s *Service) handleWebhook(r *http.Request) error {
@@ -175,50 +331,25 @@ func (s *Service) handleWebhook(r *http.Request) error {
 			return nil
 		}
 
-		cacheBranch := branch
-		if m := regexp.MustCompile("^gh-readonly-queue/([^/]+)/").FindStringSubmatch(branch); m != nil {
-			cacheBranch = m[1]
-			log.Printf("branch '%s' is from merge queue, using target branch '%s' for cache", branch, cacheBranch)
-		}
-
 		if e.HeadCommit == nil {
 			// this is a branch deletion.
 			return nil
 		}
 
-		events = append(events, &Event{
-			Event: "push",
-			Attributes: map[string]string{
-				"branch": branch,
-			},
-			Repo:           getRepoFromPushEvent(e),
-			SHA:            *e.HeadCommit.ID,
-			InstallationID: *e.Installation.ID,
-			Cache: []string{
-				fmt.Sprintf("branch-%s", cacheBranch),
-				fmt.Sprintf("branch-%s", *e.Repo.DefaultBranch),
-			},
-			Trusted: true,
-		})
+		events = append(events, pushEvent(getRepoFromPushEvent(e), branch, *e.HeadCommit.ID, *e.Installation.ID))
 	case *github.PullRequestEvent:
+		if *e.Action == "synchronize" {
+			s.revokeTrust(*e.Repo.FullName, *e.PullRequest.Number, *e.PullRequest.Head.SHA)
+		}
 		if *e.Action == "opened" || *e.Action == "synchronize" {
-			events = append(events, &Event{
-				Event: "pull_request",
-				Attributes: map[string]string{
-					"branch": *e.PullRequest.Base.Ref,
-				},
-				Repo:           e.Repo,
-				PullRequest:    e.PullRequest,
-				CloneURL:       *e.PullRequest.Head.Repo.CloneURL,
-				SHA:            *e.PullRequest.Head.SHA,
-				InstallationID: *e.Installation.ID,
-				Cache: []string{
-					fmt.Sprintf("pr-%d", *e.PullRequest.Number),
-					fmt.Sprintf("branch-%s", *e.PullRequest.Base.Ref),
-					fmt.Sprintf("branch-%s", *e.Repo.DefaultBranch),
-				},
-				Trusted: isPRTrusted(e.Repo, e.PullRequest),
-			})
+			events = append(events, s.pullRequestEvent(e.Repo, e.PullRequest, *e.Installation.ID))
+		}
+	case *github.CheckRunEvent:
+		if *e.Action == "rerequested" {
+			err := s.handleCheckRunRerequested(ctx, gh, e)
+			if err != nil {
+				log.Printf("failed handling check run re-run: %v", err)
+			}
 		}
 	case *github.IssueCommentEvent:
 		if *e.Action == "created" {
@@ -241,7 +372,7 @@ func (s *Service) handleWebhook(r *http.Request) error {
 			event.Attributes = map[string]string{}
 		}
 
-		err = s.handleEvent(ctx, gh, event)
+		_, err = s.handleEvent(ctx, gh, event, "")
 		if err != nil {
 			return err
 		}
@@ -250,104 +381,72 @@ func (s *Service) handleWebhook(r *http.Request) error {
 	return nil
 }
 
-func (s *Service) handleCommands(ctx context.Context, gh *github.Client, outEvents *[]*Event, e *github.IssueCommentEvent) error {
-	errors := ""
-
-	for _, line := range strings.Split(*e.Comment.Body, "\n") {
-		command, ok := strings.CutPrefix(line, "bender ")
-		if !ok {
-			continue
-		}
-
-		err := s.handleCommand(ctx, gh, outEvents, e, command)
-		if err != nil {
-			log.Printf("Failed to handle command `%s`: %v", command, err)
-			errors += fmt.Sprintf("`%s`: %v\n", command, err)
-		}
+func pushEvent(repo *github.Repository, branch string, sha string, installationID int64) *Event {
+	cacheBranch := branch
+	if m := regexp.MustCompile("^gh-readonly-queue/([^/]+)/").FindStringSubmatch(branch); m != nil {
+		cacheBranch = m[1]
+		log.Printf("branch '%s' is from merge queue, using target branch '%s' for cache", branch, cacheBranch)
 	}
 
-	if errors != "" {
-		_, _, err := gh.Issues.CreateComment(ctx, *e.Repo.Owner.Login, *e.Repo.Name, *e.Issue.Number, &github.IssueComment{
-			Body: github.String(errors),
-		})
-		if err != nil {
-			log.Printf("Failed to post comment with command errors: %v", err)
-		}
+	return &Event{
+		Event: "push",
+		Attributes: map[string]string{
+			"branch": branch,
+		},
+		Repo:           repo,
+		SHA:            sha,
+		InstallationID: installationID,
+		Cache: []string{
+			fmt.Sprintf("branch-%s", cacheBranch),
+			fmt.Sprintf("branch-%s", *repo.DefaultBranch),
+		},
+		Trusted: true,
 	}
-
-	return nil
 }
 
-func (s *Service) handleCommand(ctx context.Context, gh *github.Client, outEvents *[]*Event, e *github.IssueCommentEvent, command string) error {
-	dir, err := parseDirective(command)
-	if err != nil {
-		return err
+func (s *Service) pullRequestEvent(repo *github.Repository, pr *github.PullRequest, installationID int64) *Event {
+	event := &Event{
+		Event: "pull_request",
+		Attributes: map[string]string{
+			"branch": *pr.Base.Ref,
+		},
+		Repo:           repo,
+		PullRequest:    pr,
+		CloneURL:       *pr.Head.Repo.CloneURL,
+		SHA:            *pr.Head.SHA,
+		InstallationID: installationID,
+		Cache: []string{
+			fmt.Sprintf("pr-%d", *pr.Number),
+			fmt.Sprintf("branch-%s", *pr.Base.Ref),
+			fmt.Sprintf("branch-%s", *repo.DefaultBranch),
+		},
+		Trusted: isPRTrusted(repo, pr),
 	}
-
-	if len(dir.Args) == 0 {
-		return errors.New("no command?")
-	}
-
-	switch dir.Args[0] {
-	case "run":
-		if len(dir.Args) != 1 || len(dir.Conditions) != 0 {
-			return errors.Errorf("'run' takes no arguments")
+	if !event.Trusted {
+		if a := s.trustApproval(*repo.FullName, *pr.Number, *pr.Head.SHA); a != nil {
+			event.Trusted = true
+			event.TrustedBy = a
 		}
-
-		// check perms
-		perms, _, err := gh.Repositories.GetPermissionLevel(ctx, *e.Repo.Owner.Login, *e.Repo.Name, *e.Comment.User.Login)
-		if err != nil {
-			return err
-		}
-		if *perms.Permission != "admin" && *perms.Permission != "write" {
-			return errors.Errorf("permission denied")
-		}
-
-		// get PR
-		if e.Issue.PullRequestLinks == nil {
-			return errors.Errorf("This is not a pull request!")
-		}
-		pr, _, err := gh.PullRequests.Get(ctx, *e.Repo.Owner.Login, *e.Repo.Name, *e.Issue.Number)
-		if err != nil {
-			return err
-		}
-
-		*outEvents = append(*outEvents, &Event{
-			Event: "pull_request",
-			Attributes: map[string]string{
-				"branch": *pr.Base.Ref,
-			},
-			Repo:           e.Repo,
-			PullRequest:    pr,
-			CloneURL:       *pr.Head.Repo.CloneURL,
-			SHA:            *pr.Head.SHA,
-			InstallationID: *e.Installation.ID,
-			Cache: []string{
-				fmt.Sprintf("pr-%d", *pr.Number),
-				fmt.Sprintf("branch-%s", *pr.Base.Ref),
-				fmt.Sprintf("branch-%s", *e.Repo.DefaultBranch),
-			},
-			Trusted: isPRTrusted(e.Repo, pr),
-		})
-		return nil
-	default:
-		return errors.Errorf("unknown command '%s'", dir.Args[0])
 	}
+	return event
 }
 
-func (s *Service) handleEvent(ctx context.Context, gh *github.Client, event *Event) error {
+// handleEvent queues the jobs whose `## on` directives match the event, and returns
+// copies of them as they were queued.
+// If jobName is not empty, only that job is considered.
+func (s *Service) handleEvent(ctx context.Context, gh *github.Client, event *Event, jobName string) ([]*Job, error) {
 	getOpts := &github.RepositoryContentGetOptions{
 		Ref: event.SHA,
 	}
 	_, dir, _, err := gh.Repositories.GetContents(ctx, *event.Repo.Owner.Login, *event.Repo.Name, ".github/ci", getOpts)
 	if is404(err) {
 		log.Printf("`.github/ci` directory does not exist")
-		return nil
+		return nil, nil
 	} else if err != nil {
-		return err
+		return nil, err
 	} else if dir == nil {
 		log.Printf("`.github/ci` is not a directory")
-		return nil
+		return nil, nil
 	}
 
 	var jobs []*Job
@@ -356,15 +455,18 @@ func (s *Service) handleEvent(ctx context.Context, gh *github.Client, event *Eve
 		if *f.Type != "file" {
 			continue
 		}
+		if jobName != "" && removeExtension(*f.Name) != jobName {
+			continue
+		}
 
 		file, _, _, err := gh.Repositories.GetContents(ctx, *event.Repo.Owner.Login, *event.Repo.Name, *f.Path, getOpts)
 		if err != nil {
-			return err
+			return nil, err
 		}
 
 		content, err := file.GetContent()
 		if err != nil {
-			return err
+			return nil, err
 		}
 
 		meta, err := parseMeta(content)
@@ -403,15 +505,44 @@ func (s *Service) handleEvent(ctx context.Context, gh *github.Client, event *Eve
 				Script:          *f.Path,
 				Permissions:     meta.Permissions,
 				PermissionRepos: meta.PermissionRepos,
+				Concurrency:     meta.Concurrency,
+				Timeout:         meta.Timeout,
+				Image:           meta.Image,
+				Dockerfile:      meta.Dockerfile,
+				Resources:       meta.Resources,
+				Matchers:        meta.Matchers,
+				State:           JobQueued,
+				CreatedAt:       time.Now(),
 			})
 		}
 	}
 
+	if jobName != "" && len(jobs) == 0 {
+		return nil, errors.Errorf("no job '%s' runs on this event", jobName)
+	}
+
+	hold := false
+	if s.config.NewContributorApproval && event.PullRequest != nil && !event.Trusted && event.ApprovedBy == "" && len(jobs) != 0 {
+		hold, err = s.isNewContributor(ctx, gh, event.Repo, event.PullRequest)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// Copies for the caller, since the scheduler changes the jobs once they're queued.
+	res := make([]*Job, 0, len(jobs))
 	for _, job := range jobs {
-		go s.runJob(context.Background(), job)
+		c := *job
+		if hold {
+			c.State = JobAwaitingApproval
+			s.holdJob(ctx, gh, job)
+		} else {
+			s.enqueueJob(ctx, gh, job)
+		}
+		res = append(res, &c)
 	}
 
-	return nil
+	return res, nil
 }
 
 func parseEventInstallationID(payload []byte) (int64, error) {
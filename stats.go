@@ -0,0 +1,236 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const statsSampleInterval = 5 * time.Second
+
+// Jobs keep at most this many samples, they're saved with the job. Past it,
+// every other sample is dropped and they're kept half as often.
+const statsMaxSamples = 500
+
+// StatsSample is a snapshot of a job cgroup's resource usage.
+// Counters (CPU and IO) are cumulative since the job started.
+type StatsSample struct {
+	// Time since the job started.
+	Offset       time.Duration `json:"offset"`
+	CPUUsec      int64         `json:"cpu_usec"`
+	Memory       int64         `json:"memory"`
+	Pids         int64         `json:"pids"`
+	IOReadBytes  int64         `json:"io_read_bytes"`
+	IOWriteBytes int64         `json:"io_write_bytes"`
+}
+
+type JobStats struct {
+	Samples []StatsSample `json:"samples"`
+
+	Duration     time.Duration `json:"duration"`
+	CPUUsec      int64         `json:"cpu_usec"`
+	UserUsec     int64         `json:"user_usec"`
+	SystemUsec   int64         `json:"system_usec"`
+	MemoryPeak   int64         `json:"memory_peak"`
+	PidsPeak     int64         `json:"pids_peak"`
+	IOReadBytes  int64         `json:"io_read_bytes"`
+	IOWriteBytes int64         `json:"io_write_bytes"`
+}
+
+// readCgroupKeyValues reads a cgroup file with "key value" lines, like cpu.stat.
+func readCgroupKeyValues(path string) map[string]int64 {
+	res := map[string]int64{}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return res
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		key, value, ok := strings.Cut(line, " ")
+		if !ok {
+			continue
+		}
+		if n, err := strconv.ParseInt(value, 10, 64); err == nil {
+			res[key] = n
+		}
+	}
+	return res
+}
+
+func readCgroupInt(path string) int64 {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return 0
+	}
+	n, _ := strconv.ParseInt(strings.TrimSpace(string(data)), 10, 64)
+	return n
+}
+
+// readIOStat sums read and written bytes over all devices in an io.stat file.
+func readIOStat(path string) (read int64, write int64) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return 0, 0
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		for _, field := range strings.Fields(line) {
+			key, value, ok := strings.Cut(field, "=")
+			if !ok {
+				continue
+			}
+			n, err := strconv.ParseInt(value, 10, 64)
+			if err != nil {
+				continue
+			}
+			switch key {
+			case "rbytes":
+				read += n
+			case "wbytes":
+				write += n
+			}
+		}
+	}
+	return read, write
+}
+
+// statsSampler periodically samples the resource usage of a job cgroup.
+type statsSampler struct {
+	dir   string
+	start time.Time
+
+	mutex sync.Mutex
+	stats JobStats
+	// One in every `every` samples is kept, ticks is how many were taken.
+	every int
+	ticks int
+
+	stopC chan struct{}
+	doneC chan struct{}
+}
+
+func (cg *Cgroup) startSampling(path string) *statsSampler {
+	sampler := &statsSampler{
+		dir:   filepath.Join(cg.mountpoint, path),
+		start: time.Now(),
+		every: 1,
+		stopC: make(chan struct{}),
+		doneC: make(chan struct{}),
+	}
+	go sampler.run()
+	return sampler
+}
+
+func (sm *statsSampler) run() {
+	defer close(sm.doneC)
+
+	ticker := time.NewTicker(statsSampleInterval)
+	defer ticker.Stop()
+
+	for {
+		sm.sample(false)
+		select {
+		case <-ticker.C:
+		case <-sm.stopC:
+			sm.sample(true)
+			return
+		}
+	}
+}
+
+// sample updates the stats. The last sample is always kept.
+func (sm *statsSampler) sample(last bool) {
+	cpu := readCgroupKeyValues(filepath.Join(sm.dir, "cpu.stat"))
+	ioRead, ioWrite := readIOStat(filepath.Join(sm.dir, "io.stat"))
+	sample := StatsSample{
+		Offset:       time.Since(sm.start),
+		CPUUsec:      cpu["usage_usec"],
+		Memory:       readCgroupInt(filepath.Join(sm.dir, "memory.current")),
+		Pids:         readCgroupInt(filepath.Join(sm.dir, "pids.current")),
+		IOReadBytes:  ioRead,
+		IOWriteBytes: ioWrite,
+	}
+
+	sm.mutex.Lock()
+	defer sm.mutex.Unlock()
+
+	st := &sm.stats
+	if len(st.Samples) >= statsMaxSamples {
+		kept := st.Samples[:0]
+		for i := 0; i < len(st.Samples); i += 2 {
+			kept = append(kept, st.Samples[i])
+		}
+		st.Samples = kept
+		sm.every *= 2
+	}
+	if sm.ticks%sm.every == 0 || last {
+		st.Samples = append(st.Samples, sample)
+	}
+	sm.ticks++
+	st.Duration = sample.Offset
+	st.CPUUsec = sample.CPUUsec
+	st.UserUsec = cpu["user_usec"]
+	st.SystemUsec = cpu["system_usec"]
+	st.IOReadBytes = sample.IOReadBytes
+	st.IOWriteBytes = sample.IOWriteBytes
+	if sample.Pids > st.PidsPeak {
+		st.PidsPeak = sample.Pids
+	}
+
+	// memory.peak needs Linux 5.19+, if it's not there use the highest sample.
+	peak := readCgroupInt(filepath.Join(sm.dir, "memory.peak"))
+	if peak < sample.Memory {
+		peak = sample.Memory
+	}
+	if peak > st.MemoryPeak {
+		st.MemoryPeak = peak
+	}
+}
+
+// stop takes a last sample and returns the collected stats.
+// It must be called before the cgroup is deleted.
+func (sm *statsSampler) stop() *JobStats {
+	close(sm.stopC)
+	<-sm.doneC
+
+	sm.mutex.Lock()
+	defer sm.mutex.Unlock()
+	stats := sm.stats
+	return &stats
+}
+
+func humanBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
+
+// summary returns a human-readable summary of the stats, one item per line.
+func (st *JobStats) summary() []string {
+	cpu := time.Duration(st.CPUUsec) * time.Microsecond
+	avgCPUs := 0.0
+	if st.Duration > 0 {
+		avgCPUs = float64(cpu) / float64(st.Duration)
+	}
+
+	return []string{
+		fmt.Sprintf("duration: %v", st.Duration.Round(time.Second)),
+		fmt.Sprintf("cpu time: %v (user %v, system %v), %.2f cpus on average",
+			cpu.Round(time.Second),
+			(time.Duration(st.UserUsec) * time.Microsecond).Round(time.Second),
+			(time.Duration(st.SystemUsec) * time.Microsecond).Round(time.Second),
+			avgCPUs),
+		fmt.Sprintf("peak memory: %s", humanBytes(st.MemoryPeak)),
+		fmt.Sprintf("peak pids: %d", st.PidsPeak),
+		fmt.Sprintf("io: %s read, %s written", humanBytes(st.IOReadBytes), humanBytes(st.IOWriteBytes)),
+	}
+}
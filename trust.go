@@ -0,0 +1,114 @@
+package main
+
+import (
+	"context"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/google/go-github/v52/github"
+	"github.com/sqlbunny/errors"
+)
+
+// TrustApproval records a maintainer trusting a fork PR's commit with
+// `bender trust`, so its jobs get secrets and elevated permissions.
+type TrustApproval struct {
+	SHA       string    `json:"sha"`
+	User      string    `json:"user"`
+	CreatedAt time.Time `json:"created_at"`
+	// Set when the PR gets new commits. Approvals only apply to the commit they were given for.
+	RevokedAt *time.Time `json:"revoked_at,omitempty"`
+}
+
+// trustApproval returns the approval for the given commit of a PR, or nil if it has none.
+func (s *Service) trustApproval(repo string, number int, sha string) *TrustApproval {
+	approvals, err := s.db.getTrustApprovals(repo, number)
+	if err != nil {
+		log.Printf("failed to get trust approvals for %s#%d: %v", repo, number, err)
+		return nil
+	}
+	for i := len(approvals) - 1; i >= 0; i-- {
+		a := approvals[i]
+		if a.SHA == sha && a.RevokedAt == nil {
+			return &a
+		}
+	}
+	return nil
+}
+
+// checkHeadSHA checks that sha, given in a command, is a prefix of the PR's
+// head commit. Commands must name the commit they're for, so they can't apply
+// to a commit pushed after the maintainer looked at the PR.
+func checkHeadSHA(pr *github.PullRequest, sha string) error {
+	head := *pr.Head.SHA
+	if len(sha) < 7 || !strings.HasPrefix(head, strings.ToLower(sha)) {
+		return errors.Errorf("the PR's head commit is %s, not %s", head, sha)
+	}
+	return nil
+}
+
+// approveTrust trusts the head commit of a PR, which must start with sha.
+func (s *Service) approveTrust(repo string, pr *github.PullRequest, sha string, user string) error {
+	if err := checkHeadSHA(pr, sha); err != nil {
+		return err
+	}
+	head := *pr.Head.SHA
+
+	log.Printf("%s#%d: @%s trusted %s", repo, *pr.Number, user, head)
+	return s.db.updateTrustApprovals(repo, *pr.Number, func(approvals []TrustApproval) []TrustApproval {
+		return append(approvals, TrustApproval{
+			SHA:       head,
+			User:      user,
+			CreatedAt: time.Now(),
+		})
+	})
+}
+
+// revokeTrust revokes the approvals of a PR for commits other than sha.
+func (s *Service) revokeTrust(repo string, number int, sha string) {
+	err := s.db.updateTrustApprovals(repo, number, func(approvals []TrustApproval) []TrustApproval {
+		now := time.Now()
+		for i := range approvals {
+			if approvals[i].SHA != sha && approvals[i].RevokedAt == nil {
+				log.Printf("%s#%d: revoking trust in %s, the PR has new commits", repo, number, approvals[i].SHA)
+				approvals[i].RevokedAt = &now
+			}
+		}
+		return approvals
+	})
+	if err != nil {
+		log.Printf("failed to revoke trust approvals for %s#%d: %v", repo, number, err)
+	}
+}
+
+// rerunJob returns a new run of the job. Trust from `bender trust` is checked
+// again, since it may have been revoked.
+func (s *Service) rerunJob(job *Job) *Job {
+	newJob := job.newRun()
+	if job.TrustedBy != nil && job.PullRequest != nil {
+		if a := s.trustApproval(*job.Repo.FullName, *job.PullRequest.Number, job.SHA); a == nil {
+			event := *job.Event
+			event.Trusted = false
+			event.TrustedBy = nil
+			newJob.Event = &event
+		}
+	}
+	return newJob
+}
+
+// isNewContributor returns true if the author of the PR isn't a collaborator
+// and has never had a PR merged into the repo.
+func (s *Service) isNewContributor(ctx context.Context, gh *github.Client, repo *github.Repository, pr *github.PullRequest) (bool, error) {
+	switch pr.GetAuthorAssociation() {
+	case "OWNER", "MEMBER", "COLLABORATOR", "CONTRIBUTOR":
+		return false, nil
+	}
+
+	// author_association only says COLLABORATOR for explicitly added collaborators,
+	// not for people with access through a team.
+	canWrite, err := s.hasWriteAccess(ctx, gh, repo, *pr.User.Login)
+	if err != nil {
+		return false, err
+	}
+	return !canWrite, nil
+}
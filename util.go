@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"crypto/rand"
 	"encoding/hex"
 	"log"
@@ -8,6 +9,7 @@ import (
 	"os"
 	"os/exec"
 	"strings"
+	"sync"
 
 	"github.com/bradleyfalzon/ghinstallation/v2"
 	"github.com/google/go-github/v52/github"
@@ -133,3 +135,72 @@ func (s *Service) githubClient(installationID int64) (*github.Client, error) {
 	gh := github.NewClient(&http.Client{Transport: itr})
 	return gh, nil
 }
+
+// repoGithubClient returns a client for the app's installation on a repo,
+// and the installation ID.
+func (s *Service) repoGithubClient(ctx context.Context, owner string, repo string) (*github.Client, int64, error) {
+	atr, err := ghinstallation.NewAppsTransport(http.DefaultTransport, s.config.Github.AppID, []byte(s.config.Github.PrivateKey))
+	if err != nil {
+		return nil, 0, err
+	}
+
+	inst, _, err := github.NewClient(&http.Client{Transport: atr}).Apps.FindRepositoryInstallation(ctx, owner, repo)
+	if err != nil {
+		return nil, 0, errors.Errorf("failed to find installation for %s/%s: %w", owner, repo, err)
+	}
+
+	gh, err := s.githubClient(*inst.ID)
+	if err != nil {
+		return nil, 0, err
+	}
+	return gh, *inst.ID, nil
+}
+
+// keyedMutex is a mutex per key, which can be waited for with a context.
+// The zero value is ready to use.
+type keyedMutex struct {
+	mutex sync.Mutex
+	locks map[string]*keyedLock
+}
+
+type keyedLock struct {
+	c chan struct{}
+	// number of holders and waiters, the lock is deleted when it's 0.
+	refs int
+}
+
+// lock locks key, and returns the function that unlocks it. If ctx is done
+// first, it returns ctx's cause.
+func (m *keyedMutex) lock(ctx context.Context, key string) (func(), error) {
+	m.mutex.Lock()
+	if m.locks == nil {
+		m.locks = map[string]*keyedLock{}
+	}
+	l, ok := m.locks[key]
+	if !ok {
+		l = &keyedLock{c: make(chan struct{}, 1)}
+		m.locks[key] = l
+	}
+	l.refs++
+	m.mutex.Unlock()
+
+	release := func() {
+		m.mutex.Lock()
+		l.refs--
+		if l.refs == 0 {
+			delete(m.locks, key)
+		}
+		m.mutex.Unlock()
+	}
+
+	select {
+	case l.c <- struct{}{}:
+		return func() {
+			<-l.c
+			release()
+		}, nil
+	case <-ctx.Done():
+		release()
+		return nil, context.Cause(ctx)
+	}
+}